@@ -0,0 +1,82 @@
+package psec
+
+// bytesPS is a Stream over a []byte, which saves converting the input to a
+// string first. It works just like stringPS, and is likewise immutable; the
+// bytes must not be modified during the parse.
+type bytesPS struct {
+	data     []byte
+	pos      uint
+	filename string
+	line     int
+	col      int
+	value    interface{}
+	state    interface{}
+	tail     *bytesPS
+
+	// hitEnd, if set, records that Head found the end of the data. Incremental
+	// uses it to tell whether more input could change the parse.
+	hitEnd *bool
+}
+
+func (s *bytesPS) Head() (byte, bool) {
+	if s.pos >= uint(len(s.data)) {
+		if s.hitEnd != nil {
+			*s.hitEnd = true
+		}
+		return 0, true
+	}
+	return s.data[s.pos], false
+}
+
+func (s *bytesPS) Tail() Stream {
+	if s.tail == nil {
+		s.tail = &bytesPS{
+			data:     s.data,
+			pos:      s.pos + 1,
+			filename: s.filename,
+			state:    s.state,
+			hitEnd:   s.hitEnd,
+		}
+		s.tail.line, s.tail.col = advanceLoc(s.line, s.col, s.data[s.pos])
+	}
+	return s.tail
+}
+
+func (s *bytesPS) Value() interface{} { return s.value }
+func (s *bytesPS) SetValue(v interface{}) Stream {
+	dup := *s
+	dup.value = v
+	return &dup
+}
+
+func (s *bytesPS) State() interface{} { return s.state }
+func (s *bytesPS) SetState(st interface{}) Stream {
+	dup := *s
+	dup.state = st
+	dup.tail = nil // The cached tail carries the old state.
+	return &dup
+}
+
+func (s *bytesPS) Loc() *Loc {
+	return &Loc{Filename: s.filename, Line: s.line, Col: s.col, Offset: int(s.pos)}
+}
+
+func (s *bytesPS) Offset() int { return int(s.pos) }
+
+// RemainingInput has to copy the remaining bytes into a string.
+func (s *bytesPS) RemainingInput() string {
+	return string(s.data[s.pos:])
+}
+
+func (s *bytesPS) textTo(to Stream) string {
+	return string(s.data[s.pos:to.Offset()])
+}
+
+// ParseBytes is a variant of ParseString which parses a []byte directly.
+func (g *Grammar) ParseBytes(filename string, data []byte) (interface{}, error) {
+	return g.parse(&bytesPS{
+		data:     data,
+		filename: filename,
+		line:     1,
+	}, g.startSymbol, g.newContext())
+}
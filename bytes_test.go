@@ -0,0 +1,91 @@
+package psec
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseBytes(t *testing.T) {
+	inputs := []string{
+		"{ \"arr\": [1,-8], \"obj\":{\"k\":\"v\"}, \"empty\"  : {} }",
+		"   [   77, \"str here\", false   ]   ",
+		"[1,\n 2",
+	}
+	for _, in := range inputs {
+		want, wantErr := grammar.ParseString("test", in)
+		got, gotErr := grammar.ParseBytes("test", []byte(in))
+		if fmt.Sprint(want) != fmt.Sprint(got) {
+			t.Errorf("%q: ParseBytes gave %v, ParseString gave %v", in, got, want)
+		}
+		if fmt.Sprint(wantErr) != fmt.Sprint(gotErr) {
+			t.Errorf("%q: ParseBytes error %v, ParseString error %v", in, gotErr, wantErr)
+		}
+	}
+}
+
+func TestBytes(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Bytes(Many(AnyChar())))
+	input := []byte{'a', 0x00, 0xff, 0xc3, '\n'}
+	res, err := g.ParseBytes("test", input)
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if b, ok := res.([]byte); !ok || !bytes.Equal(b, input) {
+		t.Errorf("expected %v, got %#v", input, res)
+	}
+}
+
+// Between and Nested only need the text of their open to report it unclosed,
+// so a successful parse mustn't copy the rest of the input at each one.
+func BenchmarkParseBytesBetween(b *testing.B) {
+	g := NewGrammar()
+	g.AddSymbol("START", Many(Between(Literal("("), Literal("a"), Literal(")"))))
+	input := []byte(strings.Repeat("(a)", 20000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := g.ParseBytes("bench", input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParseBytesTakeWhile(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Seq(TakeWhile1(isAlphaNum), TakeWhileNoneOf("x"), Captured(Literal("x"))))
+	r, err := g.ParseBytes("test", []byte("abc12 -+x"))
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if s := fmt.Sprintf("%q", r); s != `["abc12" " -+" "x"]` {
+		t.Errorf("wrong result: %s", s)
+	}
+}
+
+// TakeWhile's value is just the bytes it matched, however much input remains.
+func BenchmarkParseBytesTakeWhile(b *testing.B) {
+	g := NewGrammar()
+	g.AddSymbol("START", Many(Seq(TakeWhile1(isAlphaNum), Literal(" "))))
+	input := []byte(strings.Repeat("word ", 40000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := g.ParseBytes("bench", input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Each identifier starts with the keyword, so Keyword rejects it every time.
+func BenchmarkParseBytesKeyword(b *testing.B) {
+	g := NewGrammar()
+	g.AddSymbol("START", Many(Seq(Alt(Keyword("if", AlphaNum()), TakeWhile1(isAlphaNum)), Literal(" "))))
+	input := []byte(strings.Repeat("iffy ", 20000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := g.ParseBytes("bench", input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package psec
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// Cache holds the results of chosen symbols across many parses, for inputs
+// which share common snippets, such as the same header on many documents. See
+// Grammar.SetCache.
+// A symbol's result is reused wherever the input starts with text it matched
+// before, so only cache symbols whose match doesn't depend on what follows the
+// text they consume, or on the user state. A greedy Many1(Letter()) is unsafe,
+// for example: having matched "abc", its cached result would also be reused on
+// "abcd". A delimited form, like a header ending in a blank line, is fine.
+// Cached values are shared between parses, so treat them as immutable.
+// A Cache is safe for concurrent use.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // Of *cacheEntry, most recently used first.
+	entries map[cacheKey]*list.Element
+	lengths map[string]map[int]int // symbol -> text length -> entry count
+	hits    int
+	misses  int
+}
+
+type cacheKey struct {
+	symbol string
+	length int
+	hash   uint64
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	text  string
+	value interface{}
+}
+
+// NewCache returns an empty Cache which holds at most size results, discarding
+// the least recently used beyond that.
+func NewCache(size int) *Cache {
+	c := &Cache{size: size}
+	c.Clear()
+	return c
+}
+
+// Clear empties the cache, and resets its statistics.
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order = list.New()
+	c.entries = make(map[cacheKey]*list.Element)
+	c.lengths = make(map[string]map[int]int)
+	c.hits, c.misses = 0, 0
+}
+
+// Len returns the number of results in the cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// Stats returns how many times a cached symbol was looked up and found, and
+// how many times it had to be parsed.
+func (c *Cache) Stats() (hits, misses int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+func hashText(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// lookup finds a result for symbol whose text the input rest starts with,
+// preferring the longest.
+func (c *Cache) lookup(symbol, rest string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var lengths []int
+	for n := range c.lengths[symbol] {
+		if n <= len(rest) {
+			lengths = append(lengths, n)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(lengths)))
+	for _, n := range lengths {
+		text := rest[:n]
+		el, ok := c.entries[cacheKey{symbol, n, hashText(text)}]
+		if ok && el.Value.(*cacheEntry).text == text {
+			c.order.MoveToFront(el)
+			c.hits++
+			return el.Value.(*cacheEntry), true
+		}
+	}
+	c.misses++
+	return nil, false
+}
+
+func (c *Cache) add(symbol, text string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey{symbol, len(text), hashText(text)}
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		c.forget(el.Value.(*cacheEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key, text, value})
+	if c.lengths[symbol] == nil {
+		c.lengths[symbol] = make(map[int]int)
+	}
+	c.lengths[symbol][len(text)]++
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		c.forget(oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// forget removes the bookkeeping for an entry already removed from order.
+func (c *Cache) forget(key cacheKey) {
+	delete(c.entries, key)
+	lengths := c.lengths[key.symbol]
+	if lengths[key.length]--; lengths[key.length] == 0 {
+		delete(lengths, key.length)
+	}
+}
+
+// SetCache makes the grammar keep the results of the named symbols in c, and
+// reuse them in later parses. Passing a nil Cache turns caching off.
+// Since one Cache can be shared by several grammars, and results are looked up
+// by symbol name, only share it between grammars whose cached symbols agree.
+// Looking up a cached symbol needs the rest of the input, so with ParseBytes
+// and ParseReader each lookup copies all the remaining input, and ParseReader
+// reads it all into memory; on large inputs, prefer ParseString.
+func (g *Grammar) SetCache(c *Cache, symbols ...string) {
+	g.cache = c
+	g.cached = make(map[string]bool)
+	for _, s := range symbols {
+		g.cached[s] = true
+	}
+}
+
+// parseCached runs the symbol name, whose parser is inner, using the cache.
+func (c *Cache) parseCached(name string, inner Parser, ps Stream, g *parseContext) (Stream, *ParseError) {
+	if e, ok := c.lookup(name, ps.RemainingInput()); ok {
+		for i := 0; i < len(e.text); i++ {
+			ps = ps.Tail()
+		}
+		return ps.SetValue(e.value), nil
+	}
+
+	res, err := inner.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	if text := matchedText(ps, res); text != "" {
+		c.add(name, text, res.Value())
+	}
+	return res, nil
+}
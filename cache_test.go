@@ -0,0 +1,109 @@
+package psec
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Documents with a header, ending at a blank line, and then a body. The
+// header's action counts how often it runs.
+func buildHeaderGrammar(runs *int) *Grammar {
+	g := NewGrammar()
+	g.WithAction("header", Stringify(ManyTill(AnyChar(), Literal("\n\n"))),
+		func(res interface{}, loc *Loc) (interface{}, error) {
+			*runs++
+			return strings.Split(res.(string), "\n"), nil
+		})
+	g.AddSymbol("START", Seq(Symbol("header"), Stringify(Many(AnyChar()))))
+	return g
+}
+
+func TestCache(t *testing.T) {
+	runs := 0
+	g := buildHeaderGrammar(&runs)
+	cache := NewCache(10)
+	g.SetCache(cache, "header")
+
+	header := "format: 2\nauthor: ann\n\n"
+	for i, doc := range []string{header + "one", header + "two", "format: 1\n\nthree", header + "four"} {
+		r, err := g.ParseString("test", doc)
+		if err != nil {
+			t.Fatalf("doc %d: unexpected failure: %v", i, err)
+		}
+		if i == 3 {
+			if got := fmt.Sprintf("%q", r); got != `[["format: 2" "author: ann"] "four"]` {
+				t.Errorf("wrong result from a cache hit: %s", got)
+			}
+		}
+	}
+	if runs != 2 {
+		t.Errorf("expected the header to be parsed twice, got %d", runs)
+	}
+	if hits, misses := cache.Stats(); hits != 2 || misses != 2 {
+		t.Errorf("expected 2 hits and 2 misses, got %d and %d", hits, misses)
+	}
+
+	// Positions after a cache hit are still right.
+	g.AddSymbol("START", Seq(Symbol("header"), Literal("x")))
+	_, err := g.ParseString("test", header+"y")
+	if err == nil || err.Error() != "test line 4 col 0: expected literal 'x'" {
+		t.Errorf("wrong error after a cache hit: %v", err)
+	}
+
+	cache.Clear()
+	if cache.Len() != 0 {
+		t.Errorf("expected an empty cache after Clear, got %d", cache.Len())
+	}
+	runs = 0
+	g.ParseString("test", header+"x")
+	if runs != 1 {
+		t.Errorf("expected the header to be parsed again after Clear, got %d", runs)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	runs := 0
+	g := buildHeaderGrammar(&runs)
+	cache := NewCache(2)
+	g.SetCache(cache, "header")
+
+	for _, h := range []string{"a", "b", "a", "c", "b"} {
+		if _, err := g.ParseString("test", h+"\n\nbody"); err != nil {
+			t.Fatalf("unexpected failure: %v", err)
+		}
+	}
+	// "b" was the least recently used when "c" was added.
+	if runs != 4 {
+		t.Errorf("expected 4 parses of the header, got %d", runs)
+	}
+	if cache.Len() != 2 {
+		t.Errorf("expected the cache to stay at 2 entries, got %d", cache.Len())
+	}
+}
+
+func benchmarkHeaders(b *testing.B, cache bool) {
+	runs := 0
+	g := buildHeaderGrammar(&runs)
+	if cache {
+		g.SetCache(NewCache(100), "header")
+	}
+	header := strings.Repeat("key: some fairly long value\n", 50) + "\n"
+	docs := make([]string, 100)
+	for i := range docs {
+		docs[i] = fmt.Sprintf("%sdocument %d", header, i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, doc := range docs {
+			if _, err := g.ParseString("bench", doc); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkHeadersUncached(b *testing.B) { benchmarkHeaders(b, false) }
+func BenchmarkHeadersCached(b *testing.B)   { benchmarkHeaders(b, true) }
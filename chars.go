@@ -0,0 +1,43 @@
+package psec
+
+// Predefined parsers for the common ASCII character classes. Each yields the
+// matched byte, and fails with "expected <class>".
+
+func isDigit(c byte) bool    { return '0' <= c && c <= '9' }
+func isLetter(c byte) bool   { return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' }
+func isAlphaNum(c byte) bool { return isDigit(c) || isLetter(c) }
+func isHexDigit(c byte) bool { return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F' }
+
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '\v', '\f':
+		return true
+	}
+	return false
+}
+
+// Digit parses a decimal digit, 0-9.
+func Digit() Parser {
+	return Label("digit", Satisfy(isDigit))
+}
+
+// Letter parses an ASCII letter, a-z or A-Z.
+func Letter() Parser {
+	return Label("letter", Satisfy(isLetter))
+}
+
+// AlphaNum parses an ASCII letter or decimal digit.
+func AlphaNum() Parser {
+	return Label("letter or digit", Satisfy(isAlphaNum))
+}
+
+// Space parses a single ASCII whitespace character: space, \t, \n, \r, \v or
+// \f.
+func Space() Parser {
+	return Label("space", Satisfy(isSpace))
+}
+
+// HexDigit parses a hexadecimal digit, 0-9, a-f or A-F.
+func HexDigit() Parser {
+	return Label("hex digit", Satisfy(isHexDigit))
+}
@@ -0,0 +1,38 @@
+package psec
+
+import "testing"
+
+func TestSatisfy(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Satisfy(func(c byte) bool { return c%2 == 0 }))
+	expectByte(t, g, "b", 'b')
+	expectError(t, g, "a", "unexpected a")
+	expectError(t, g, "", "unexpected EOF")
+}
+
+func TestCharClasses(t *testing.T) {
+	classes := []struct {
+		p        Parser
+		accept   string
+		reject   string
+		expected string
+	}{
+		{Digit(), "0759", "a/:", "digit"},
+		{Letter(), "azAZq", "09@[`{", "letter"},
+		{AlphaNum(), "azAZ09", "@_ ", "letter or digit"},
+		{Space(), " \t\n\r\v\f", "a_", "space"},
+		{HexDigit(), "09afAF", "gG@", "hex digit"},
+	}
+
+	for _, c := range classes {
+		g := NewGrammar()
+		g.AddSymbol("START", c.p)
+		for i := 0; i < len(c.accept); i++ {
+			expectByte(t, g, c.accept[i:i+1], c.accept[i])
+		}
+		for i := 0; i < len(c.reject); i++ {
+			expectError(t, g, c.reject[i:i+1], "expected "+c.expected)
+		}
+		expectError(t, g, "", "expected "+c.expected)
+	}
+}
@@ -0,0 +1,169 @@
+package psec
+
+import "fmt"
+
+// Parsers for comments. Their values are all nil, so that they can be skipped
+// along with whitespace, eg.
+//
+//	g.SetWhitespace(ManyDrop(Alt(Space(), LineComment("//"), BlockComment("/*", "*/"))))
+
+// skipPrefix returns the stream following s, if the input at ps starts with s,
+// and nil otherwise.
+func skipPrefix(ps Stream, s string) Stream {
+	for i := 0; i < len(s); i++ {
+		c, eof := ps.Head()
+		if eof || c != s[i] {
+			return nil
+		}
+		ps = ps.Tail()
+	}
+	return ps
+}
+
+// BlockComment parses a comment from open to the first close after it, such as
+// C's /* ... */. Comments don't nest, so a second open inside the comment is
+// just part of it; see NestedBlockComment for those that do.
+// An unterminated comment is an error at its open.
+func BlockComment(open, close string) Parser {
+	return &pBlockComment{open, close}
+}
+
+type pBlockComment struct {
+	open, close string
+}
+
+func (p *pBlockComment) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
+	if ps = skipPrefix(ps, p.open); ps == nil {
+		return nil, start.Loc().mkErrorExpect("comment")
+	}
+	for {
+		if end := skipPrefix(ps, p.close); end != nil {
+			return end.SetValue(nil), nil
+		}
+		if _, eof := ps.Head(); eof {
+			return nil, start.Loc().mkErrorMessage("unterminated comment")
+		}
+		ps = ps.Tail()
+	}
+}
+
+func (p *pBlockComment) describe() string {
+	return fmt.Sprintf("BlockComment(%q, %q)", p.open, p.close)
+}
+
+// NestedBlockComment is a variant of BlockComment for comments that nest, as in
+// Rust and Haskell: each open inside the comment must be matched by its own
+// close, and the comment only ends at the close matching the first open.
+// An unterminated comment is an error at the outermost open.
+func NestedBlockComment(open, close string) Parser {
+	return &pNestedBlockComment{open, close}
+}
+
+type pNestedBlockComment struct {
+	open, close string
+}
+
+func (p *pNestedBlockComment) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
+	if ps = skipPrefix(ps, p.open); ps == nil {
+		return nil, start.Loc().mkErrorExpect("comment")
+	}
+	depth := 1
+	for {
+		if end := skipPrefix(ps, p.close); end != nil {
+			depth--
+			if depth == 0 {
+				return end.SetValue(nil), nil
+			}
+			ps = end
+		} else if next := skipPrefix(ps, p.open); next != nil {
+			depth++
+			ps = next
+		} else if _, eof := ps.Head(); eof {
+			return nil, start.Loc().mkErrorMessage("unterminated comment")
+		} else {
+			ps = ps.Tail()
+		}
+	}
+}
+
+func (p *pNestedBlockComment) describe() string {
+	return fmt.Sprintf("NestedBlockComment(%q, %q)", p.open, p.close)
+}
+
+// LineComment parses a comment from start to the end of the line, such as C's
+// // comments. It stops before the newline, or at the end of the input.
+func LineComment(start string) Parser {
+	return &pLineComment{start}
+}
+
+type pLineComment struct {
+	start string
+}
+
+func (p *pLineComment) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
+	if ps = skipPrefix(ps, p.start); ps == nil {
+		return nil, start.Loc().mkErrorExpect("comment")
+	}
+	for {
+		if c, eof := ps.Head(); eof || c == '\n' {
+			return ps.SetValue(nil), nil
+		}
+		ps = ps.Tail()
+	}
+}
+
+func (p *pLineComment) describe() string {
+	return fmt.Sprintf("LineComment(%q)", p.start)
+}
+
+// SkipBOM skips a UTF-8 byte order mark, U+FEFF, if there is one. It always
+// succeeds, with value nil. Use it at the start of the input.
+func SkipBOM() Parser {
+	return &pSkipBOM{}
+}
+
+type pSkipBOM struct{}
+
+func (p *pSkipBOM) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	if rest := skipPrefix(ps, "\uFEFF"); rest != nil {
+		ps = rest
+	}
+	return ps.SetValue(nil), nil
+}
+
+func (p *pSkipBOM) describe() string {
+	return "SkipBOM"
+}
+
+// SkipShebang skips a #! line, such as "#!/usr/bin/env python", along with its
+// newline, if there is one. It always succeeds, with value nil. Use it at the
+// start of the input, after any SkipBOM.
+func SkipShebang() Parser {
+	return &pSkipShebang{}
+}
+
+type pSkipShebang struct{}
+
+func (p *pSkipShebang) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	rest := skipPrefix(ps, "#!")
+	if rest == nil {
+		return ps.SetValue(nil), nil
+	}
+	for {
+		c, eof := rest.Head()
+		if eof {
+			return rest.SetValue(nil), nil
+		}
+		rest = rest.Tail()
+		if c == '\n' {
+			return rest.SetValue(nil), nil
+		}
+	}
+}
+
+func (p *pSkipShebang) describe() string {
+	return "SkipShebang"
+}
@@ -0,0 +1,78 @@
+package psec
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBlockComment(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Skip(BlockComment("/*", "*/"), Stringify(Many(AnyChar()))))
+	expectString(t, g, "/* x * / y */b", "b")
+	expectString(t, g, "/**/", "")
+
+	// Comments don't nest: the first close ends the comment.
+	expectString(t, g, "/* /* x */ */b", " */b")
+	expectError(t, g, "/* x", "unterminated comment")
+	expectError(t, g, "/ * x */b", "expected comment")
+
+	g.AddSymbol("START", Seq(BlockComment("/*", "*/"), Literal("b")))
+	if r, err := g.ParseString("test", "/* x */b"); err != nil || r.([]interface{})[0] != nil {
+		t.Errorf("expected a nil value, got %v, %v", r, err)
+	}
+}
+
+func TestLineComment(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Skip(LineComment("#"), Stringify(Many(AnyChar()))))
+	expectString(t, g, "# note\nrest", "\nrest")
+	expectString(t, g, "# note at EOF", "")
+	expectString(t, g, "#", "")
+	expectError(t, g, "x", "expected comment")
+}
+
+func TestCommentsAsWhitespace(t *testing.T) {
+	g := NewGrammar()
+	g.SetWhitespace(ManyDrop(Alt(Space(), LineComment("//"), BlockComment("/*", "*/"))))
+	g.AddSymbol("START", Many(Tok("x")))
+	expectStrings(t, g, "x // one\nx/* two */x /* three\n */ x//", []string{"x", "x", "x", "x"})
+	expectErrorAt(t, g, "x /* x", 2, "incomplete parse, expected EOF but input remains: /* x")
+}
+
+func TestNestedBlockComment(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Skip(NestedBlockComment("/*", "*/"), Stringify(Many(AnyChar()))))
+	expectString(t, g, "/* a /* b */ c */", "")
+	expectString(t, g, "/* a /* b /**/ */ c */d", "d")
+	expectString(t, g, "/**/*/", "*/")
+	expectError(t, g, "/* /* */", "unterminated comment")
+	expectError(t, g, "x", "expected comment")
+
+	// ML-style comments.
+	g.AddSymbol("START", Skip(NestedBlockComment("(*", "*)"), Stringify(Many(AnyChar()))))
+	expectString(t, g, "(* (* *) *)x", "x")
+}
+
+func TestSkipBOM(t *testing.T) {
+	g := buildJSONParser()
+	g.AddSymbol("START", Skip(SkipBOM(), g.symbols["START"]))
+	r, err := g.ParseString("test", "\uFEFF{\"k\": [1, 2]}")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if s := fmt.Sprint(r); s != "map[k:[1 2]]" {
+		t.Errorf("wrong result: %s", s)
+	}
+	expectValue(t, g, "7", 7)
+	expectErrorAt(t, g, "\uFEFF\uFEFF7", 1, "expected one of literal '[', literal '{', literal 'null', literal 'false', literal 'true', literal '\"', range(0..9)")
+}
+
+func TestSkipShebang(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Skip(SkipBOM(), Skip(SkipShebang(), Stringify(Many(AnyChar())))))
+	expectString(t, g, "#!/bin/sh\necho hi\n", "echo hi\n")
+	expectString(t, g, "\uFEFF#!/bin/sh\r\necho hi", "echo hi")
+	expectString(t, g, "#!/bin/sh", "")
+	expectString(t, g, "# not\n", "# not\n")
+	expectString(t, g, "", "")
+}
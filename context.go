@@ -0,0 +1,48 @@
+package psec
+
+import "context"
+
+// contextCheckInterval is how many symbols are entered between checks of the
+// context passed to ParseStringContext.
+const contextCheckInterval = 256
+
+// ParseStringContext is a variant of ParseString which gives up if ctx is
+// cancelled or its deadline passes, returning ctx.Err(). That bounds the time
+// spent on pathological inputs, which can make a backtracking grammar take
+// exponential time.
+// The context is checked periodically as the parse enters symbols, so grammars
+// without any Symbols are never interrupted.
+func (g *Grammar) ParseStringContext(ctx context.Context, filename, str string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pc := g.newContext()
+	pc.ctx = ctx
+	v, err := g.parse(&stringPS{
+		str:      str,
+		filename: filename,
+		line:     1,
+		arena:    new(streamArena),
+	}, g.startSymbol, pc)
+	if pc.aborted != nil {
+		return nil, pc.aborted
+	}
+	return v, err
+}
+
+// checkContext returns a committed error if the parse should be abandoned
+// because its context is done, so that nothing backtracks and carries on.
+func (g *parseContext) checkContext(ps Stream) *ParseError {
+	if g.ctx == nil {
+		return nil
+	}
+	if g.aborted == nil {
+		if g.steps++; g.steps%contextCheckInterval != 0 {
+			return nil
+		}
+		if g.aborted = g.ctx.Err(); g.aborted == nil {
+			return nil
+		}
+	}
+	return &ParseError{loc: ps.Loc(), message: g.aborted.Error(), committed: true}
+}
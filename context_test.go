@@ -0,0 +1,64 @@
+package psec
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStringContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Once armed, cancels the parse when it reaches the "!".
+	armed := false
+	g := NewGrammar()
+	g.AddSymbol("item", Alt(Letter(), Then(Literal("!"), ParserFunc(func(s Stream) (Stream, error) {
+		if armed {
+			cancel()
+		}
+		return s, nil
+	}))))
+	g.AddSymbol("START", Many(Recover(Symbol("item"), Literal(";"))))
+
+	input := strings.Repeat("a", 1000) + "!" + strings.Repeat("b", 10000)
+	if _, err := g.ParseStringContext(ctx, "test", input); err != nil {
+		t.Errorf("unexpected failure without cancelling: %v", err)
+	}
+	armed = true
+	_, err := g.ParseStringContext(ctx, "test", input)
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	_, err = g.ParseStringContext(ctx, "test", "abc")
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled for an already cancelled context, got %v", err)
+	}
+}
+
+func TestParseStringContextDeadline(t *testing.T) {
+	// Each "a" is tried three ways, so failing on a long run of them takes
+	// exponential time.
+	g := NewGrammar()
+	g.AddSymbol("START", Alt(
+		Seq(Literal("a"), Symbol("START"), Literal("b")),
+		Seq(Literal("a"), Symbol("START"), Literal("c")),
+		Literal("a")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := g.ParseStringContext(ctx, "test", strings.Repeat("a", 40)+"x")
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("parse wasn't abandoned promptly, took %v", elapsed)
+	}
+
+	v, err := g.ParseStringContext(context.Background(), "test", "aab")
+	if err != nil || v == nil {
+		t.Errorf("unexpected failure: %v", err)
+	}
+}
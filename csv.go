@@ -0,0 +1,41 @@
+package psec
+
+// Parsers for CSV, as in RFC 4180, with the delimiter of your choice.
+// Fields may be quoted with ", doubling any quotes inside them, and quoted
+// fields may contain the delimiter and newlines. Fields are never trimmed.
+
+// CSVRecord parses one record, a line of fields separated by delim. Its value
+// is the fields, as a []string. It stops before the newline ending the record.
+func CSVRecord(delim byte) Parser {
+	field := Dispatch(map[byte]Parser{
+		// A quote can only start a quoted field, so commit to it.
+		'"': Cut(DoubledQuoteString('"')),
+	}, TakeWhileNoneOf(string(delim)+"\"\r\n"))
+	return Map(SepByN(field, Literal(string(delim)), 1, -1),
+		func(v interface{}, loc *Loc) (interface{}, error) {
+			fields := v.([]interface{})
+			out := make([]string, len(fields))
+			for i, f := range fields {
+				out[i] = f.(string)
+			}
+			return out, nil
+		})
+}
+
+// CSVFile parses a series of records, each ending with "\n" or "\r\n"; the
+// last record's newline is optional. Its value is the records, as a
+// [][]string.
+func CSVFile(delim byte) Parser {
+	// A record at the end of the input would be one empty field, so there has
+	// to be something left for it.
+	record := Skip(NotFollowedBy(EOF()), CSVRecord(delim))
+	return Map(SepEndBy(record, Alt(Literal("\r\n"), Literal("\n"))),
+		func(v interface{}, loc *Loc) (interface{}, error) {
+			records := v.([]interface{})
+			out := make([][]string, len(records))
+			for i, r := range records {
+				out[i] = r.([]string)
+			}
+			return out, nil
+		})
+}
@@ -0,0 +1,45 @@
+package psec
+
+import (
+	"reflect"
+	"testing"
+)
+
+func expectCSV(t *testing.T, g *Grammar, input string, expected interface{}) {
+	t.Helper()
+	r, err := g.ParseString("test", input)
+	if err != nil {
+		t.Errorf("unexpected failure on %q: %v", input, err)
+		return
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("wrong result for %q: expected %q, got %q", input, expected, r)
+	}
+}
+
+func TestCSVRecord(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", CSVRecord(','))
+	expectCSV(t, g, "a,b,c", []string{"a", "b", "c"})
+	expectCSV(t, g, `"a,b",c`, []string{"a,b", "c"})
+	expectCSV(t, g, `"she said ""hi""",x`, []string{`she said "hi"`, "x"})
+	expectCSV(t, g, "a,,", []string{"a", "", ""})
+	expectCSV(t, g, "", []string{""})
+	expectErrorAt(t, g, `a,"b`, 2, "unterminated string")
+
+	g.AddSymbol("START", CSVRecord('\t'))
+	expectCSV(t, g, "a,b\tc", []string{"a,b", "c"})
+}
+
+func TestCSVFile(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", CSVFile(','))
+	expectCSV(t, g, "name,notes\r\nbob,\"line 1\nline 2, more\"\r\n", [][]string{
+		{"name", "notes"},
+		{"bob", "line 1\nline 2, more"},
+	})
+	expectCSV(t, g, "a,b\nc,d", [][]string{{"a", "b"}, {"c", "d"}})
+	expectCSV(t, g, "a\n\nb\n", [][]string{{"a"}, {""}, {"b"}})
+	expectCSV(t, g, "", [][]string{})
+	expectErrorAt(t, g, "\"b\"c\nd\n", 3, "incomplete parse, expected EOF but input remains: c\nd\n")
+}
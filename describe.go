@@ -0,0 +1,77 @@
+package psec
+
+import (
+	"fmt"
+	"strings"
+)
+
+// describer is implemented by all the built-in parsers, to render themselves in
+// an EBNF-like notation for Grammar.Describe.
+type describer interface {
+	describe() string
+}
+
+// describe renders any parser, falling back on its type for parsers from
+// outside the package.
+func describe(p Parser) string {
+	if d, ok := p.(describer); ok {
+		return d.describe()
+	}
+	return fmt.Sprintf("%T", p)
+}
+
+// describeTerm is like describe, but parenthesizes sequences and alternatives,
+// for use as an operand.
+func describeTerm(p Parser) string {
+	s := describe(p)
+	depth := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(' || c == '[' || c == '{' || c == '<':
+			depth++
+		case c == ')' || c == ']' || c == '}' || c == '>':
+			depth--
+		case c == ' ' && depth == 0:
+			return "(" + s + ")"
+		}
+	}
+	return s
+}
+
+// describeSeq renders a sequence of parsers.
+func describeSeq(ps []Parser) string {
+	parts := make([]string, len(ps))
+	for i, p := range ps {
+		parts[i] = describeTerm(p)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Describe renders the grammar as a readable specification, one rule per line
+// in an EBNF-like notation: "name = definition". The start symbol comes first,
+// and the rest are sorted by name.
+// Literals are quoted, ranges are written "a".."z", and repetitions use the
+// usual *, + and ?, with x{2,5} for bounded ones. Labelled parsers appear as
+// their labels, eg. <digit>, and other combinators by their names. Actions
+// aren't shown.
+func (g *Grammar) Describe() string {
+	var sb strings.Builder
+	line := func(name string) {
+		fmt.Fprintf(&sb, "%s = %s\n", name, describe(g.symbols[name]))
+	}
+	if _, ok := g.symbols[g.startSymbol]; ok {
+		line(g.startSymbol)
+	}
+	for _, name := range g.Symbols() {
+		if name != g.startSymbol {
+			line(name)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,49 @@
+package psec
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDescribe(t *testing.T) {
+	desc := buildJSONParser().Describe()
+	for _, want := range []string{
+		"START = ws jsonValue ws\n",
+		"jsonValue = array | object | null | bool | string | number\n",
+		`array = "[" ws SepBy(jsonValue, comma) ws "]"` + "\n",
+		`number = OneOf("+-")? "0".."9"+` + "\n",
+		`ws = OneOf(" \t\r\n")*` + "\n",
+	} {
+		if !strings.Contains(desc, want) {
+			t.Errorf("description is missing %q:\n%s", want, desc)
+		}
+	}
+	if !strings.HasPrefix(desc, "START = ") || strings.Count(desc, "\n") != 11 {
+		t.Errorf("expected START first, and a line per rule:\n%s", desc)
+	}
+}
+
+func TestDescribeParsers(t *testing.T) {
+	for _, c := range []struct {
+		p    Parser
+		want string
+	}{
+		{Seq(Alt(Literal("a"), Literal("b")), Literal("c")), `("a" | "b") "c"`},
+		{Many1(Seq(Digit(), Optional(Letter()))), `(<digit> <letter>?)+`},
+		{ManyRange(Literal("x"), 2, 5), `"x"{2,5}`},
+		{Count(3, Symbol("item")), `item{3}`},
+		{NotFollowedBy(LiteralIC("end")), `!"end"i`},
+		{Map(SepBy1(Regexp(`[a-z]+`), Tok(",")), nil), `SepBy1(/[a-z]+/, Lexeme(","))`},
+		{RuneRange('à', 'ÿ'), `"à".."ÿ"`},
+		{Alt(Integer(), Float()), `<integer> | <number>`},
+		{nilParser{}, "psec.nilParser"},
+	} {
+		if got := describe(c.p); got != c.want {
+			t.Errorf("expected %s, got %s", c.want, got)
+		}
+	}
+}
+
+type nilParser struct{}
+
+func (nilParser) Parse(ps Stream, g *parseContext) (Stream, *ParseError) { return ps, nil }
@@ -0,0 +1,152 @@
+package psec
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// ParseEBNF builds a grammar from a specification in a subset of EBNF, parsed
+// with psec itself. The specification is a list of rules, each
+//
+//	name = alternatives ;
+//
+// where names are letters, digits and underscores, and each alternative is a
+// sequence of:
+//
+//	name          a reference to another rule, ie. Symbol(name)
+//	"text"        a literal, ie. Literal; 'text' works too
+//	"a".."z"      a range of characters, ie. Range or RuneRange
+//	( ... )       a group of alternatives
+//	x*  x+  x?    Many(x), Many1(x) and Optional(x)
+//
+// separated by |. Whitespace and (* comments *) are ignored, but there is no
+// whitespace skipping in the grammar built: it matches exactly what the rules
+// say. Values are those of the combinators, so a sequence yields a slice.
+// The start symbol is START if the specification defines it, and otherwise the
+// first rule. It is an error to refer to rules that aren't defined, or to define
+// a rule twice.
+func ParseEBNF(spec string) (*Grammar, error) {
+	var refs []ebnfRef
+	meta := buildEBNFGrammar(&refs)
+	res, err := meta.ParseString("ebnf", spec)
+	if err != nil {
+		return nil, err
+	}
+
+	g := NewGrammar()
+	rules := res.([]interface{})
+	for _, r := range rules {
+		rule := r.(ebnfRule)
+		if _, ok := g.symbols[rule.name]; ok {
+			return nil, rule.loc.Errorf("rule '%s' is defined twice", rule.name)
+		}
+		g.AddSymbol(rule.name, rule.parser)
+	}
+	for _, ref := range refs {
+		if _, ok := g.symbols[ref.name]; !ok {
+			return nil, ref.loc.Errorf("undefined rule '%s'", ref.name)
+		}
+	}
+
+	if len(rules) > 0 {
+		if _, ok := g.symbols["START"]; !ok {
+			g.SetStartSymbol(rules[0].(ebnfRule).name)
+		}
+	}
+	return g, nil
+}
+
+type ebnfRule struct {
+	name   string
+	parser Parser
+	loc    *Loc
+}
+
+type ebnfRef struct {
+	name string
+	loc  *Loc
+}
+
+// buildEBNFGrammar builds the grammar for EBNF specifications, whose value is a
+// slice of ebnfRules. Each rule reference is recorded in refs.
+func buildEBNFGrammar(refs *[]ebnfRef) *Grammar {
+	g := NewGrammar()
+	g.SetWhitespace(ManyDrop(Alt(Space(), NestedBlockComment("(*", "*)"))))
+
+	g.AddSymbol("name", Lexeme(Stringify(Many1(Alt(AlphaNum(), OneOf("_"))))))
+	g.AddSymbol("literal", Lexeme(Alt(QuotedString('"', nil), QuotedString('\'', nil))))
+
+	// Once a literal is followed by "..", it must be a range.
+	g.AddSymbol("range", Skip(LookAhead(Seq(Symbol("literal"), Tok(".."))), Cut(Symbol("bounds"))))
+	g.WithActionLoc("bounds", Seq(Symbol("literal"), Tok(".."), Symbol("literal")),
+		func(res interface{}, loc *Loc) (interface{}, error) {
+			parts := res.([]interface{})
+			lo, hi := parts[0].(string), parts[2].(string)
+			if utf8.RuneCountInString(lo) != 1 || utf8.RuneCountInString(hi) != 1 {
+				return nil, fmt.Errorf("range bounds must be single characters, not %q..%q", lo, hi)
+			}
+			if len(lo) == 1 && len(hi) == 1 {
+				return Range(lo[0], hi[0]), nil
+			}
+			l, _ := utf8.DecodeRuneInString(lo)
+			h, _ := utf8.DecodeRuneInString(hi)
+			return RuneRange(l, h), nil
+		})
+
+	g.AddSymbol("primary", Alt(
+		Symbol("range"),
+		Map(Symbol("literal"), func(res interface{}, loc *Loc) (interface{}, error) {
+			return Literal(res.(string)), nil
+		}),
+		MapLoc(Symbol("name"), func(res interface{}, loc *Loc) (interface{}, error) {
+			*refs = append(*refs, ebnfRef{res.(string), loc})
+			return Symbol(res.(string)), nil
+		}),
+		Between(Tok("("), Symbol("alternatives"), Tok(")"))))
+
+	g.WithAction("postfix", Seq(Symbol("primary"), Optional(Lexeme(OneOf("*+?")))),
+		func(res interface{}, loc *Loc) (interface{}, error) {
+			parts := res.([]interface{})
+			p := parts[0].(Parser)
+			switch parts[1] {
+			case byte('*'):
+				return Many(p), nil
+			case byte('+'):
+				return Many1(p), nil
+			case byte('?'):
+				return Optional(p), nil
+			}
+			return p, nil
+		})
+
+	g.WithAction("sequence", Many1(Symbol("postfix")),
+		func(res interface{}, loc *Loc) (interface{}, error) {
+			return oneOrMany(res.([]interface{}), Seq), nil
+		})
+
+	g.WithAction("alternatives", SepBy1(Symbol("sequence"), Tok("|")),
+		func(res interface{}, loc *Loc) (interface{}, error) {
+			return oneOrMany(res.([]interface{}), Alt), nil
+		})
+
+	g.WithActionLoc("rule", Seq(Symbol("name"), Tok("="), Cut(Then(Symbol("alternatives"), Tok(";")))),
+		func(res interface{}, loc *Loc) (interface{}, error) {
+			parts := res.([]interface{})
+			return ebnfRule{parts[0].(string), parts[2].(Parser), loc}, nil
+		})
+
+	g.AddSymbol("START", Skip(g.whitespace, Many(Symbol("rule"))))
+	return g
+}
+
+// oneOrMany combines a list of parsers with combine, unless there's only one.
+func oneOrMany(items []interface{}, combine func(...Parser) Parser) Parser {
+	if len(items) == 1 {
+		return items[0].(Parser)
+	}
+	parsers := make([]Parser, len(items))
+	for i, p := range items {
+		parsers[i] = p.(Parser)
+	}
+	return combine(parsers...)
+}
@@ -0,0 +1,68 @@
+package psec
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseEBNF(t *testing.T) {
+	g, err := ParseEBNF(`
+		(* Balanced parentheses. *)
+		parens = ("(" parens ")")* ;
+	`)
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if g.StartSymbol() != "parens" {
+		t.Errorf("expected the first rule to be the start, got %s", g.StartSymbol())
+	}
+	for _, in := range []string{"", "()", "(()())", "((()))()"} {
+		if _, err := g.ParseString("test", in); err != nil {
+			t.Errorf("%q: unexpected failure: %v", in, err)
+		}
+	}
+	expectError(t, g, "(()", "incomplete parse, expected EOF but input remains: (()")
+	expectErrorAt(t, g, "())", 2, "incomplete parse, expected EOF but input remains: )")
+
+	g, err = ParseEBNF(`my_rule = "a" other_rule ; other_rule = "b" ;`)
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if g.StartSymbol() != "my_rule" {
+		t.Errorf("expected my_rule to be the start, got %s", g.StartSymbol())
+	}
+	expectStrings(t, g, "ab", []string{"a", "b"})
+}
+
+func TestParseEBNFOperators(t *testing.T) {
+	g, err := ParseEBNF(`
+		digits = "0".."9"+ ;
+		START = sign? digits (("+" | '-') digits)* ;
+		sign = "-" ;
+	`)
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	r, err := g.ParseString("test", "-12+3")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if got := fmt.Sprintf("%q", r); got != `["-" ['1' '2'] [["+" ['3']]]]` {
+		t.Errorf("wrong result: %s", got)
+	}
+	expectErrorAt(t, g, "1+", 1, "incomplete parse, expected EOF but input remains: +")
+}
+
+func TestParseEBNFErrors(t *testing.T) {
+	for spec, want := range map[string]string{
+		`a = b ;`:            "ebnf line 1 col 4: undefined rule 'b'",
+		`a = "x" ; a = "y";`: "ebnf line 1 col 10: rule 'a' is defined twice",
+		`a = "x"`:            "ebnf line 1 col 7: expected literal ';'",
+		`a = "ab".."z" ;`:    `ebnf line 1 col 4: range bounds must be single characters, not "ab".."z"`,
+	} {
+		_, err := ParseEBNF(spec)
+		if err == nil || err.Error() != want {
+			t.Errorf("%s: expected error %q, got %v", spec, want, err)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package psec
+
+import (
+	"fmt"
+	"sort"
+)
+
+// BinaryOp is the value an operator parser passed to the Chain family must
+// produce: a function combining the values of the terms either side of it.
+type BinaryOp func(a, b interface{}) interface{}
+
+// Chainl1 parses one or more term, separated by op, and combines their values
+// left-associatively: "a-b-c" becomes op(op(a, b), c).
+// op's value must be a BinaryOp, or a func(a, b interface{}) interface{}.
+// Like SepBy, a trailing op that isn't followed by a term is not consumed.
+func Chainl1(term, op Parser) Parser {
+	return &pChain{term, op, false, false, nil}
+}
+
+// Chainr1 is like Chainl1, but combines the terms right-associatively:
+// "a^b^c" becomes op(a, op(b, c)).
+func Chainr1(term, op Parser) Parser {
+	return &pChain{term, op, true, false, nil}
+}
+
+// Chainl is a variant of Chainl1 which also accepts zero terms, in which case
+// its value is def.
+func Chainl(term, op Parser, def interface{}) Parser {
+	return &pChain{term, op, false, true, def}
+}
+
+// Chainr is a variant of Chainr1 which also accepts zero terms, in which case
+// its value is def.
+func Chainr(term, op Parser, def interface{}) Parser {
+	return &pChain{term, op, true, true, def}
+}
+
+type pChain struct {
+	term, op   Parser
+	right      bool
+	optional   bool
+	defaultVal interface{}
+}
+
+func asBinaryOp(v interface{}) BinaryOp {
+	if f, ok := v.(func(a, b interface{}) interface{}); ok {
+		return f
+	}
+	return v.(BinaryOp)
+}
+
+func (p *pChain) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	ps2, err := p.term.Parse(ps, g)
+	if err != nil {
+		if p.optional && !err.committed {
+			return ps.SetValue(p.defaultVal), nil
+		}
+		return nil, err
+	}
+	ps = ps2
+
+	terms := []interface{}{ps.Value()}
+	var ops []BinaryOp
+	for {
+		opPS, err := p.op.Parse(ps, g)
+		if err != nil {
+			if err.committed {
+				return nil, err
+			}
+			break
+		}
+		termPS, err := p.term.Parse(opPS, g)
+		if err != nil {
+			if err.committed {
+				return nil, err
+			}
+			break
+		}
+		ops = append(ops, asBinaryOp(opPS.Value()))
+		terms = append(terms, termPS.Value())
+		ps = termPS
+	}
+
+	return ps.SetValue(foldChain(terms, ops, p.right)), nil
+}
+
+func (p *pChain) describe() string {
+	name := "Chainl"
+	if p.right {
+		name = "Chainr"
+	}
+	if !p.optional {
+		name += "1"
+	}
+	return fmt.Sprintf("%s(%s, %s)", name, describe(p.term), describe(p.op))
+}
+
+// foldChain combines len(ops)+1 terms with the ops between them.
+func foldChain(terms []interface{}, ops []BinaryOp, right bool) interface{} {
+	if right {
+		acc := terms[len(terms)-1]
+		for i := len(ops) - 1; i >= 0; i-- {
+			acc = ops[i](terms[i], acc)
+		}
+		return acc
+	}
+
+	acc := terms[0]
+	for i, op := range ops {
+		acc = op(acc, terms[i+1])
+	}
+	return acc
+}
+
+// UnaryOp combines the value of an operand with a prefix or postfix operator.
+type UnaryOp func(a interface{}) interface{}
+
+// Assoc is the associativity of an infix operator.
+type Assoc int
+
+const (
+	AssocLeft  Assoc = iota // "a-b-c" is (a-b)-c
+	AssocRight              // "a^b^c" is a^(b^c)
+	AssocNone               // "a<b<c" is not allowed
+)
+
+// ExpressionTable builds a parser for expressions over prefix, postfix and
+// infix operators, from a table of their precedences and associativities.
+// Operators with a higher precedence bind more tightly.
+// Declare the operators, then call Build.
+type ExpressionTable struct {
+	term   Parser
+	levels map[int]*exprLevel
+}
+
+type exprLevel struct {
+	prefix, postfix   []Parser
+	left, right, none []Parser
+}
+
+// NewExpressionTable starts an operator table over term, the parser for the
+// expression's innermost operands. For parenthesized subexpressions, term
+// should include them, typically via a Symbol referring back to the built
+// expression parser.
+func NewExpressionTable(term Parser) *ExpressionTable {
+	return &ExpressionTable{term, make(map[int]*exprLevel)}
+}
+
+func (t *ExpressionTable) level(prec int) *exprLevel {
+	if l, ok := t.levels[prec]; ok {
+		return l
+	}
+	l := &exprLevel{}
+	t.levels[prec] = l
+	return l
+}
+
+// Infix declares a binary operator. op's own value is ignored; when it matches,
+// fn combines the operands either side.
+func (t *ExpressionTable) Infix(op Parser, prec int, assoc Assoc, fn func(a, b interface{}) interface{}) {
+	p := Map(op, func(res interface{}, loc *Loc) (interface{}, error) {
+		return BinaryOp(fn), nil
+	})
+	l := t.level(prec)
+	switch assoc {
+	case AssocLeft:
+		l.left = append(l.left, p)
+	case AssocRight:
+		l.right = append(l.right, p)
+	default:
+		l.none = append(l.none, p)
+	}
+}
+
+// Prefix declares a unary operator written before its operand.
+func (t *ExpressionTable) Prefix(op Parser, prec int, fn func(a interface{}) interface{}) {
+	l := t.level(prec)
+	l.prefix = append(l.prefix, unaryOp(op, fn))
+}
+
+// Postfix declares a unary operator written after its operand.
+func (t *ExpressionTable) Postfix(op Parser, prec int, fn func(a interface{}) interface{}) {
+	l := t.level(prec)
+	l.postfix = append(l.postfix, unaryOp(op, fn))
+}
+
+func unaryOp(op Parser, fn func(a interface{}) interface{}) Parser {
+	return Map(op, func(res interface{}, loc *Loc) (interface{}, error) {
+		return UnaryOp(fn), nil
+	})
+}
+
+// Build returns the expression parser: one layer per precedence level, from
+// the tightest-binding outwards.
+func (t *ExpressionTable) Build() Parser {
+	var precs []int
+	for prec := range t.levels {
+		precs = append(precs, prec)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(precs)))
+
+	p := t.term
+	for _, prec := range precs {
+		l := t.levels[prec]
+		if len(l.prefix) > 0 || len(l.postfix) > 0 {
+			p = &pUnary{p, altOrNil(l.prefix), altOrNil(l.postfix)}
+		}
+		if len(l.left) > 0 || len(l.right) > 0 || len(l.none) > 0 {
+			p = &pExprLevel{p, altOrNil(l.left), altOrNil(l.right), altOrNil(l.none)}
+		}
+	}
+	return p
+}
+
+func altOrNil(ps []Parser) Parser {
+	if len(ps) == 0 {
+		return nil
+	}
+	return Alt(ps...)
+}
+
+// pUnary parses any number of prefix operators, the operand, and any number of
+// postfix operators. Postfix operators are applied first.
+type pUnary struct {
+	operand, prefix, postfix Parser
+}
+
+func (p *pUnary) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	var pre []UnaryOp
+	for p.prefix != nil {
+		ps2, err := p.prefix.Parse(ps, g)
+		if err != nil {
+			if err.committed {
+				return nil, err
+			}
+			break
+		}
+		pre = append(pre, ps2.Value().(UnaryOp))
+		ps = ps2
+	}
+
+	ps, err := p.operand.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	v := ps.Value()
+
+	for p.postfix != nil {
+		ps2, err := p.postfix.Parse(ps, g)
+		if err != nil {
+			if err.committed {
+				return nil, err
+			}
+			break
+		}
+		v = ps2.Value().(UnaryOp)(v)
+		ps = ps2
+	}
+
+	for i := len(pre) - 1; i >= 0; i-- {
+		v = pre[i](v)
+	}
+	return ps.SetValue(v), nil
+}
+
+func (p *pUnary) describe() string {
+	s := describeTerm(p.operand)
+	if p.prefix != nil {
+		s = describeTerm(p.prefix) + "* " + s
+	}
+	if p.postfix != nil {
+		s += " " + describeTerm(p.postfix) + "*"
+	}
+	return s
+}
+
+// pExprLevel parses one precedence level of infix operators. A single chain
+// can't mix associativities, so whichever kind of operator appears first is the
+// only kind accepted for the rest of the chain.
+type pExprLevel struct {
+	operand           Parser
+	left, right, none Parser
+}
+
+func (p *pExprLevel) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	ps, err := p.operand.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	terms := []interface{}{ps.Value()}
+
+	groups := []struct {
+		op    Parser
+		assoc Assoc
+	}{{p.left, AssocLeft}, {p.right, AssocRight}, {p.none, AssocNone}}
+	for _, grp := range groups {
+		if grp.op == nil {
+			continue
+		}
+
+		var ops []BinaryOp
+		for {
+			opPS, err := grp.op.Parse(ps, g)
+			if err != nil {
+				if err.committed {
+					return nil, err
+				}
+				break
+			}
+			termPS, err := p.operand.Parse(opPS, g)
+			if err != nil {
+				if err.committed {
+					return nil, err
+				}
+				break
+			}
+			ops = append(ops, opPS.Value().(BinaryOp))
+			terms = append(terms, termPS.Value())
+			ps = termPS
+			if grp.assoc == AssocNone {
+				break
+			}
+		}
+		if len(ops) > 0 {
+			return ps.SetValue(foldChain(terms, ops, grp.assoc == AssocRight)), nil
+		}
+	}
+	return ps.SetValue(terms[0]), nil
+}
+
+func (p *pExprLevel) describe() string {
+	var ops []Parser
+	for _, op := range []Parser{p.left, p.right, p.none} {
+		if op != nil {
+			ops = append(ops, op)
+		}
+	}
+	return fmt.Sprintf("Infix(%s, %s)", describe(p.operand), describe(Alt(ops...)))
+}
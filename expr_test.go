@@ -0,0 +1,209 @@
+package psec
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func expectInt(t *testing.T, g *Grammar, input string, expected int) {
+	r, err := g.ParseString("test", input)
+	if err != nil {
+		t.Errorf("unexpected failure: %v", err)
+		return
+	}
+
+	if r, ok := r.(int); ok {
+		if r != expected {
+			t.Errorf("%q: expected %d, got %d", input, expected, r)
+		}
+	} else {
+		t.Errorf("return was not an int: %#v %T", r, r)
+	}
+}
+
+func intTerm() Parser {
+	return Map(Many1(Range('0', '9')), func(res interface{}, loc *Loc) (interface{}, error) {
+		n := 0
+		for _, d := range res.([]interface{}) {
+			n = 10*n + int(d.(byte)-'0')
+		}
+		return n, nil
+	})
+}
+
+func binOp(lit string, f func(a, b int) int) Parser {
+	return Map(Literal(lit), func(res interface{}, loc *Loc) (interface{}, error) {
+		return func(a, b interface{}) interface{} {
+			return f(a.(int), b.(int))
+		}, nil
+	})
+}
+
+func sub(a, b int) int { return a - b }
+
+func TestChainl1(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Chainl1(intTerm(), binOp("-", sub)))
+	expectInt(t, g, "1-2-3", -4)
+	expectInt(t, g, "7", 7)
+	expectError(t, g, "", "minimum 1, expected range(0..9)")
+	expectErrorAt(t, g, "1-2-", 3, "incomplete parse, expected EOF but input remains: -")
+}
+
+func TestChainr1(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Chainr1(intTerm(), binOp("-", sub)))
+	expectInt(t, g, "1-2-3", 2)
+	expectInt(t, g, "7", 7)
+}
+
+func TestChainDefault(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Chainl(intTerm(), binOp("-", sub), 0))
+	expectInt(t, g, "", 0)
+	expectInt(t, g, "10-3-2", 5)
+
+	g.AddSymbol("START", Chainr(intTerm(), binOp("-", sub), 0))
+	expectInt(t, g, "", 0)
+	expectInt(t, g, "10-3-2", 9)
+}
+
+func buildCalculator() *Grammar {
+	arith := func(f func(a, b int) int) func(a, b interface{}) interface{} {
+		return func(a, b interface{}) interface{} { return f(a.(int), b.(int)) }
+	}
+	pow := func(a, b int) int {
+		n := 1
+		for i := 0; i < b; i++ {
+			n *= a
+		}
+		return n
+	}
+
+	table := NewExpressionTable(Alt(intTerm(),
+		Between(Literal("("), Symbol("expr"), Literal(")"))))
+	table.Infix(Literal("+"), 1, AssocLeft, arith(func(a, b int) int { return a + b }))
+	table.Infix(Literal("-"), 1, AssocLeft, arith(sub))
+	table.Infix(Literal("*"), 2, AssocLeft, arith(func(a, b int) int { return a * b }))
+	table.Infix(Literal("/"), 2, AssocLeft, arith(func(a, b int) int { return a / b }))
+	table.Infix(Literal("^"), 3, AssocRight, arith(pow))
+	table.Prefix(Literal("-"), 4, func(a interface{}) interface{} { return -a.(int) })
+	table.Postfix(Literal("!"), 5, func(a interface{}) interface{} {
+		n := 1
+		for i := 2; i <= a.(int); i++ {
+			n *= i
+		}
+		return n
+	})
+	table.Infix(Literal("="), 0, AssocNone, func(a, b interface{}) interface{} {
+		if a == b {
+			return 1
+		}
+		return 0
+	})
+
+	g := NewGrammar()
+	g.AddSymbol("expr", table.Build())
+	g.AddSymbol("START", Symbol("expr"))
+	return g
+}
+
+func TestExpressionTable(t *testing.T) {
+	g := buildCalculator()
+	expectInt(t, g, "2+3*4", 14)
+	expectInt(t, g, "(2+3)*4", 20)
+	expectInt(t, g, "10-4-3", 3)
+	expectInt(t, g, "100/10/5", 2)
+	expectInt(t, g, "2^3^2", 512)
+	expectInt(t, g, "2*3^2", 18)
+	expectInt(t, g, "-2+5", 3)
+	expectInt(t, g, "--2", 2)
+	expectInt(t, g, "3!+1", 7)
+	expectInt(t, g, "2*(1+(6-2)/2)", 6)
+	expectInt(t, g, "1+1=2", 1)
+	expectErrorAt(t, g, "1=1=1", 3, "incomplete parse, expected EOF but input remains: =1")
+}
+
+func TestSetStartSymbol(t *testing.T) {
+	g := buildCalculator()
+	g.AddSymbol("START", Literal("unused"))
+	g.SetStartSymbol("expr")
+	if got := g.StartSymbol(); got != "expr" {
+		t.Errorf("wrong start symbol: %s", got)
+	}
+	expectInt(t, g, "2+3*4", 14)
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a panic for an unknown start symbol")
+		}
+	}()
+	g.SetStartSymbol("nonexistent")
+}
+
+func TestCompile(t *testing.T) {
+	g := buildCalculator()
+	g.Compile()
+	expectInt(t, g, "2*(1+(6-2)/2)", 6)
+	expectInt(t, g, "2^3^2", 512)
+
+	// A clone isn't compiled, and has its own symbols.
+	dup := g.Clone()
+	dup.AddSymbol("START", Then(Symbol("expr"), Literal(";")))
+	expectInt(t, g, "1+1", 2)
+	expectErrorAt(t, dup, "1+1", 3, "expected literal ';'")
+	dup.Compile()
+	expectInt(t, dup, "1+1;", 2)
+	expectInt(t, g, "(1+1)", 2)
+
+	// Changing the grammar after compiling takes effect.
+	g.AddSymbol("expr", intTerm())
+	expectInt(t, g, "12", 12)
+	expectErrorAt(t, g, "1+1", 1, "incomplete parse, expected EOF but input remains: +1")
+	g.Compile()
+	expectErrorAt(t, g, "1+1", 1, "incomplete parse, expected EOF but input remains: +1")
+}
+
+func benchmarkCalculator(b *testing.B, compile bool) {
+	g := buildCalculator()
+	if compile {
+		g.Compile()
+	}
+	input := strings.Repeat("(1+", 200) + "1" + strings.Repeat(")*2", 200)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := g.ParseString("bench", input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCalculator(b *testing.B)         { benchmarkCalculator(b, false) }
+func BenchmarkCalculatorCompiled(b *testing.B) { benchmarkCalculator(b, true) }
+
+// A grammar that's nearly all Symbols: each item goes through a chain of
+// rules before reaching any input. The calculator spends most of its time
+// elsewhere, on values and failed alternatives, so Compile shows up here.
+func benchmarkSymbolChain(b *testing.B, compile bool) {
+	const depth = 30
+	g := NewGrammar()
+	for i := 0; i < depth; i++ {
+		g.AddSymbol(fmt.Sprintf("rule%d", i), Symbol(fmt.Sprintf("rule%d", i+1)))
+	}
+	g.AddSymbol(fmt.Sprintf("rule%d", depth), OneOf("ab"))
+	g.AddSymbol("START", ManyDrop(Symbol("rule0")))
+	if compile {
+		g.Compile()
+	}
+	input := strings.Repeat("ab", 5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := g.ParseString("bench", input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSymbolChain(b *testing.B)         { benchmarkSymbolChain(b, false) }
+func BenchmarkSymbolChainCompiled(b *testing.B) { benchmarkSymbolChain(b, true) }
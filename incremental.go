@@ -0,0 +1,58 @@
+package psec
+
+import "fmt"
+
+// Incremental parses input that arrives in pieces, such as from a network
+// connection. Feed it each chunk as it arrives, and call Result to find out
+// whether the input so far is a complete parse, a syntax error, or a prefix
+// that needs more input to decide.
+//
+// Each call to Result parses all the input fed so far from the beginning;
+// only the buffer is kept between calls.
+type Incremental struct {
+	g        *Grammar
+	startSym string
+	buf      []byte
+}
+
+// NewIncremental returns an Incremental parser for the grammar, starting from
+// startSym.
+func (g *Grammar) NewIncremental(startSym string) *Incremental {
+	if _, ok := g.symbols[startSym]; !ok {
+		panic(fmt.Sprintf("start symbol '%s' does not exist", startSym))
+	}
+	return &Incremental{g: g, startSym: startSym}
+}
+
+// Feed appends data to the input.
+func (inc *Incremental) Feed(data []byte) {
+	inc.buf = append(inc.buf, data...)
+}
+
+// Result parses the input fed so far. If it parses completely, done is true
+// and value is the result. If it fails, and no parser failed at or looked at
+// the end of the input, more input can't change the outcome: that's a syntax
+// error, so done is true and err is the *ParseError. Otherwise more input
+// might fix it, so Result returns done as false and no error.
+//
+// Only a parser asking for the next byte counts as looking at the end, not
+// one that takes the text it matched or the rest of the input. A parse which
+// succeeds is done, even if more input could have extended it (eg. the digits
+// of a number at the end of the input).
+func (inc *Incremental) Result() (value interface{}, done bool, err error) {
+	hitEnd := false
+	ps, perr := inc.g.run(&bytesPS{data: inc.buf, line: 1, hitEnd: &hitEnd}, inc.startSym, inc.g.newContext())
+	if perr != nil {
+		if hitEnd || perr.loc.Offset >= len(inc.buf) {
+			return nil, false, nil
+		}
+		return nil, true, perr
+	}
+
+	// Input left over after a successful parse is an error however much more
+	// arrives, so this doesn't wait for more.
+	if _, eof := ps.Head(); !eof {
+		return nil, true, ps.Loc().mkErrorMessage("incomplete parse, expected EOF but input remains: %s", ps.RemainingInput())
+	}
+	return ps.Value(), true, nil
+}
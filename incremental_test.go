@@ -0,0 +1,87 @@
+package psec
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIncremental(t *testing.T) {
+	inc := buildJSONParser().NewIncremental("jsonValue")
+	chunks := []string{`{"key1": -1`, `9, "kek": "s`, `tr", "arr": [1]}`}
+	for i, chunk := range chunks {
+		inc.Feed([]byte(chunk))
+		v, done, err := inc.Result()
+		if i < len(chunks)-1 {
+			if done || err != nil || v != nil {
+				t.Fatalf("chunk %d: expected to await more input, got %v, %v, %v", i, v, done, err)
+			}
+			continue
+		}
+		if !done || err != nil {
+			t.Fatalf("expected a complete parse, got %v, %v", done, err)
+		}
+		expected := map[string]interface{}{"key1": -19, "kek": "str", "arr": []interface{}{1}}
+		if !reflect.DeepEqual(v, expected) {
+			t.Errorf("expected %v, got %v", expected, v)
+		}
+	}
+}
+
+func TestIncrementalError(t *testing.T) {
+	inc := buildJSONParser().NewIncremental("jsonValue")
+	inc.Feed([]byte(`{"key1": x`))
+	if _, done, err := inc.Result(); !done || err == nil {
+		t.Fatalf("expected a syntax error, got %v, %v", done, err)
+	}
+
+	inc = buildJSONParser().NewIncremental("jsonValue")
+	inc.Feed([]byte(`[1, 2]`))
+	inc.Feed([]byte(` 3`))
+	if _, done, err := inc.Result(); !done || err == nil {
+		t.Fatalf("expected an error for trailing input, got %v, %v", done, err)
+	}
+}
+
+// Parsers which take the text they matched mustn't make a failure look like
+// it needs more input.
+func TestIncrementalMatchedText(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Between(Literal("("), TakeWhile1(isAlphaNum), Literal(")")))
+
+	inc := g.NewIncremental("START")
+	inc.Feed([]byte("(#)"))
+	if _, done, err := inc.Result(); !done || err == nil {
+		t.Errorf("expected a syntax error, got %v, %v", done, err)
+	}
+
+	inc = g.NewIncremental("START")
+	inc.Feed([]byte("(ab"))
+	if _, done, err := inc.Result(); done || err != nil {
+		t.Errorf("expected to await more input, got %v, %v", done, err)
+	}
+	inc.Feed([]byte("c)"))
+	if v, done, err := inc.Result(); !done || err != nil || v != "abc" {
+		t.Errorf("expected abc, got %v, %v, %v", v, done, err)
+	}
+}
+
+func TestIncrementalBetween(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Between(Literal("("), Literal("a"), Literal(")")))
+
+	inc := g.NewIncremental("START")
+	inc.Feed([]byte("(b)"))
+	if _, done, err := inc.Result(); !done || err == nil {
+		t.Errorf("expected a syntax error, got %v, %v", done, err)
+	}
+
+	inc = g.NewIncremental("START")
+	inc.Feed([]byte("(a"))
+	if _, done, err := inc.Result(); done || err != nil {
+		t.Errorf("expected to await more input, got %v, %v", done, err)
+	}
+	inc.Feed([]byte(")"))
+	if v, done, err := inc.Result(); !done || err != nil || v != "a" {
+		t.Errorf("expected a, got %v, %v, %v", v, done, err)
+	}
+}
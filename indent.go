@@ -0,0 +1,122 @@
+package psec
+
+// Combinators for indentation-sensitive languages, where blocks are marked out
+// by the column their lines start in, as in Python or YAML. Columns are those of
+// Loc, counting runes from 0; a tab counts as one column, like any other rune.
+// The items of a block are responsible for skipping the newlines and
+// indentation after themselves, eg. with Lexeme, so that each item starts at
+// its first non-blank character.
+
+// IndentMany parses one or more items which all start in the same column: the
+// column where IndentMany starts. It stops at the first item in any other
+// column, which typically belongs to an enclosing block. Its value is a slice
+// of the items' values.
+// Indented parsers within the items must be indented beyond this column.
+func IndentMany(item Parser) Parser {
+	return &pIndentMany{item}
+}
+
+type pIndentMany struct {
+	item Parser
+}
+
+func (p *pIndentMany) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	col := ps.Loc().Col
+	g.indents = append(g.indents, col)
+	defer func() { g.indents = g.indents[:len(g.indents)-1] }()
+
+	ps, err := p.item.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	results := []interface{}{ps.Value()}
+	for {
+		if _, eof := ps.Head(); eof || ps.Loc().Col != col {
+			break
+		}
+		next, err := p.item.Parse(ps, g)
+		if err != nil {
+			if err.committed {
+				return nil, err
+			}
+			break
+		}
+		results = append(results, next.Value())
+		ps = next
+	}
+	return ps.SetValue(results), nil
+}
+
+func (p *pIndentMany) describe() string {
+	return "IndentMany(" + describe(p.item) + ")"
+}
+
+// Indented runs p, provided it starts further right than the innermost
+// enclosing IndentMany block, or beyond column 0 outside any block. Its value is
+// p's value.
+// Typically p is itself an IndentMany, for a nested block.
+func Indented(p Parser) Parser {
+	return &pIndented{p}
+}
+
+type pIndented struct {
+	inner Parser
+}
+
+func (p *pIndented) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	enclosing := 0
+	if len(g.indents) > 0 {
+		enclosing = g.indents[len(g.indents)-1]
+	}
+	if ps.Loc().Col <= enclosing {
+		return nil, ps.Loc().mkErrorExpect("indentation beyond column %d", enclosing)
+	}
+	return p.inner.Parse(ps, g)
+}
+
+func (p *pIndented) describe() string {
+	return "Indented(" + describe(p.inner) + ")"
+}
+
+// BlockValue is the value of Block: the header's value, and the values of the
+// children under it, if any.
+type BlockValue struct {
+	Header   interface{}
+	Children []interface{}
+}
+
+// Block parses a header, followed by any number of children indented beyond
+// the header's column, as with Indented(IndentMany(child)). The children must
+// all start in the same column, and the first line in any other column ends
+// the block. Its value is a BlockValue.
+func Block(header, child Parser) Parser {
+	return &pBlock{header, &pIndentMany{child}}
+}
+
+type pBlock struct {
+	header   Parser
+	children *pIndentMany
+}
+
+func (p *pBlock) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	col := ps.Loc().Col
+	ps, err := p.header.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	block := BlockValue{Header: ps.Value()}
+	if _, eof := ps.Head(); eof || ps.Loc().Col <= col {
+		return ps.SetValue(block), nil
+	}
+
+	ps, err = p.children.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	block.Children = ps.Value().([]interface{})
+	return ps.SetValue(block), nil
+}
+
+func (p *pBlock) describe() string {
+	return "Block(" + describe(p.header) + ", " + describe(p.children.item) + ")"
+}
@@ -0,0 +1,104 @@
+package psec
+
+import (
+	"strings"
+	"testing"
+)
+
+// A tree written as an outline: each node's children are indented below it.
+// Node values are rendered as "name(child child)".
+func buildOutlineGrammar() *Grammar {
+	g := NewGrammar()
+	g.SetWhitespace(ManyDrop(OneOf(" \n")))
+	g.AddSymbol("node", Map(
+		Seq(Lexeme(Stringify(Many1(Letter()))), Optional(Indented(IndentMany(Symbol("node"))))),
+		func(res interface{}, loc *Loc) (interface{}, error) {
+			parts := res.([]interface{})
+			if parts[1] == nil {
+				return parts[0], nil
+			}
+			var children []string
+			for _, c := range parts[1].([]interface{}) {
+				children = append(children, c.(string))
+			}
+			return parts[0].(string) + "(" + strings.Join(children, " ") + ")", nil
+		}))
+	g.AddSymbol("START", Map(IndentMany(Symbol("node")),
+		func(res interface{}, loc *Loc) (interface{}, error) {
+			var nodes []string
+			for _, n := range res.([]interface{}) {
+				nodes = append(nodes, n.(string))
+			}
+			return strings.Join(nodes, " "), nil
+		}))
+	return g
+}
+
+func TestIndentMany(t *testing.T) {
+	g := buildOutlineGrammar()
+	expectString(t, g, "root\n  a\n    b\n    c\n  d\nnext\n", "root(a(b c) d) next")
+	expectString(t, g, "x", "x")
+
+	// Dedenting to a column no block started in ends the inner block, but then
+	// matches neither.
+	_, err := g.ParseString("test", "root\n    a\n  b\n")
+	if err == nil || err.Error() != "test line 3 col 2: incomplete parse, expected EOF but input remains: b\n" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestIndented(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Skip(Literal("  "), Indented(Literal("x"))))
+	expectString(t, g, "  x", "x")
+
+	g.AddSymbol("START", Indented(Literal("x")))
+	expectError(t, g, "x", "expected indentation beyond column 0")
+}
+
+func TestBlock(t *testing.T) {
+	g := NewGrammar()
+	g.SetWhitespace(ManyDrop(OneOf(" \n")))
+	name := Lexeme(Stringify(Many1(Letter())))
+	g.AddSymbol("START", Block(SeqAt(0, name, Tok(":")), name))
+
+	r, err := g.ParseString("test", "section:\n  one\n  two\n")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	b := r.(BlockValue)
+	if b.Header != "section" || len(b.Children) != 2 || b.Children[0] != "one" || b.Children[1] != "two" {
+		t.Errorf("wrong block: %#v", b)
+	}
+
+	r, err = g.ParseString("test", "empty:\n")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if b := r.(BlockValue); b.Header != "empty" || len(b.Children) != 0 {
+		t.Errorf("wrong block: %#v", b)
+	}
+
+	// Children must be indented beyond the header, and line up with each other.
+	for _, input := range []string{"section:\none\n", "section:\n  one\n two\n"} {
+		_, err := g.ParseString("test", input)
+		if err == nil || !strings.Contains(err.Error(), "incomplete parse, expected EOF but input remains") {
+			t.Errorf("expected %q to leave input unparsed, got %v", input, err)
+		}
+	}
+
+	// Nested blocks, with a header indented within an outer block.
+	g.AddSymbol("entry", Alt(Block(SeqAt(0, name, Tok(":")), Symbol("entry")), name))
+	g.AddSymbol("START", Symbol("entry"))
+	r, err = g.ParseString("test", "a:\n  b:\n    c\n  d\n")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	outer := r.(BlockValue)
+	if len(outer.Children) != 2 || outer.Children[1] != "d" {
+		t.Fatalf("wrong block: %#v", outer)
+	}
+	if inner := outer.Children[0].(BlockValue); inner.Header != "b" || len(inner.Children) != 1 {
+		t.Errorf("wrong inner block: %#v", inner)
+	}
+}
@@ -1,6 +1,11 @@
 package psec
 
-import "testing"
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+)
 
 func buildJSONParser() *Grammar {
 	g := NewGrammar()
@@ -198,3 +203,209 @@ func TestNestedObjects(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+// Rebuilds the JSON grammar's bracketed forms with Between, and checks they
+// behave like the SeqAt versions, apart from naming the unclosed bracket.
+func TestBetween(t *testing.T) {
+	g := buildJSONParser()
+	open := func(s string) Parser { return Seq(Literal(s), Symbol("ws")) }
+	close := func(s string) Parser { return Seq(Symbol("ws"), Literal(s)) }
+
+	g.AddSymbol("array",
+		Between(open("["), SepBy(Symbol("jsonValue"), Symbol("comma")), close("]")))
+	g.WithAction("object",
+		Between(open("{"), SepBy(Symbol("keyValue"), Symbol("comma")), close("}")),
+		func(res interface{}, loc *Loc) (interface{}, error) {
+			out := make(map[string]interface{})
+			for _, p := range res.([]interface{}) {
+				kv := p.(keyValue)
+				out[kv.key] = kv.value
+			}
+			return out, nil
+		})
+
+	inputs := []string{
+		"[ 7, [0, 2] ]",
+		"{ \"arr\": [1,-8], \"obj\":{\"k\":\"v\"} }",
+		"[]",
+	}
+	for _, in := range inputs {
+		want, wantErr := grammar.ParseString("test", in)
+		got, gotErr := g.ParseString("test", in)
+		if fmt.Sprint(want) != fmt.Sprint(got) {
+			t.Errorf("%q: Between gave %v, SeqAt gave %v", in, got, want)
+		}
+		if fmt.Sprint(wantErr) != fmt.Sprint(gotErr) {
+			t.Errorf("%q: Between error %v, SeqAt error %v", in, gotErr, wantErr)
+		}
+	}
+
+	expectErrorAt(t, g, "[1, 2", 5, "unclosed '[' opened at line 1 col 0, expected literal ']'")
+	expectErrorAt(t, g, "[0, [1, 2]", 10, "unclosed '[' opened at line 1 col 0, expected literal ']'")
+	expectErrorAt(t, g, "{\"k\": 1]", 7, "unclosed '{' opened at line 1 col 0, expected literal '}'")
+}
+
+func TestBetweenUnclosed(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Between(Literal("("), Stringify(Many(Letter())), Literal(")")))
+	expectString(t, g, "(abc)", "abc")
+	expectErrorAt(t, g, "(abc", 4, "unclosed '(' opened at line 1 col 0, expected literal ')'")
+	expectError(t, g, "abc)", "expected literal '('")
+}
+
+func TestClone(t *testing.T) {
+	base := buildJSONParser()
+	clone := base.Clone()
+	clone.AddSymbol("null", Literal("nil"))
+	clone.AddSymbol("extra", Literal("x"))
+
+	if _, err := clone.ParseString("test", "[nil, 1]"); err != nil {
+		t.Errorf("clone should accept nil: %v", err)
+	}
+	if _, err := clone.ParseString("test", "[null]"); err == nil {
+		t.Errorf("clone should no longer accept null")
+	}
+
+	if _, err := base.ParseString("test", "[null, 1]"); err != nil {
+		t.Errorf("original should still accept null: %v", err)
+	}
+	if _, err := base.ParseString("test", "[nil]"); err == nil {
+		t.Errorf("original should not accept nil")
+	}
+	if _, ok := base.symbols["extra"]; ok {
+		t.Errorf("symbol added to the clone leaked into the original")
+	}
+}
+
+// largeJSON builds an array of n small objects.
+func largeJSON(n int) string {
+	var sb strings.Builder
+	sb.WriteString("[")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			sb.WriteString(",\n")
+		}
+		fmt.Fprintf(&sb, `{"id": %d, "name": "item %d", "tags": [true, false, null]}`, i, i)
+	}
+	sb.WriteString("]")
+	return sb.String()
+}
+
+// BenchmarkParseString parses a large JSON input, reporting allocations and also
+// how much memory is still live at the end of the parse, before it returns.
+// The live memory stays close to the size of the input and its parsed value:
+// each stream caches its Tail, but parsers move on from the copy returned by
+// SetValue, so the Tails get cached on the copy instead. Each chain of cached
+// streams only spans a single token, and the rest can be collected as the parse
+// moves on.
+func BenchmarkParseString(b *testing.B) {
+	g := grammar.Clone()
+	var live uint64
+	g.AddSymbol("START", Map(Then(grammar.symbols["START"], EOF()),
+		func(v interface{}, loc *Loc) (interface{}, error) {
+			var stats runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&stats)
+			live += stats.HeapAlloc
+			return v, nil
+		}))
+	input := largeJSON(2000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := g.ParseString("bench", input); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(live)/float64(b.N), "live-B/op")
+}
+
+// dispatchJSON makes the grammar's jsonValue pick its branch by the first byte,
+// rather than trying each in turn.
+func dispatchJSON(g *Grammar) {
+	table := map[byte]Parser{
+		'[': Symbol("array"),
+		'{': Symbol("object"),
+		'n': Symbol("null"),
+		't': Symbol("bool"),
+		'f': Symbol("bool"),
+		'"': Symbol("string"),
+		'+': Symbol("number"),
+		'-': Symbol("number"),
+	}
+	for c := byte('0'); c <= '9'; c++ {
+		table[c] = Symbol("number")
+	}
+	g.AddSymbol("jsonValue", Dispatch(table, nil))
+}
+
+func TestDispatch(t *testing.T) {
+	g := buildJSONParser()
+	dispatchJSON(g)
+	r, err := g.ParseString("test", `{"arr": [1, -8, true, null], "obj": {"k": "v"}}`)
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if s := fmt.Sprint(r); s != "map[arr:[1 -8 true <nil>] obj:map[k:v]]" {
+		t.Errorf("wrong result: %s", s)
+	}
+	expectError(t, g, "?", "expected one of: \"+-0123456789[fnt{")
+	expectError(t, g, "nul", "expected literal 'null'")
+	expectErrorAt(t, g, "", 0, "unexpected EOF, expected one of '\"+-0123456789[fnt{'")
+
+	g.AddSymbol("START", Dispatch(map[byte]Parser{'a': Literal("ab")}, Literal("x")))
+	expectString(t, g, "ab", "ab")
+	expectString(t, g, "x", "x")
+	expectError(t, g, "y", "expected literal 'x'")
+}
+
+func benchmarkJSONValue(b *testing.B, dispatch bool) {
+	g := buildJSONParser()
+	if dispatch {
+		dispatchJSON(g)
+	}
+	input := largeJSON(2000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := g.ParseString("bench", input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONValueAlt(b *testing.B)      { benchmarkJSONValue(b, false) }
+func BenchmarkJSONValueDispatch(b *testing.B) { benchmarkJSONValue(b, true) }
+
+func TestSymbols(t *testing.T) {
+	g := buildJSONParser()
+	want := "[START array bool comma jsonValue keyValue null number object string ws]"
+	if got := fmt.Sprint(g.Symbols()); got != want {
+		t.Errorf("wrong symbols: %s", got)
+	}
+	if got := g.StartSymbol(); got != "START" {
+		t.Errorf("wrong start symbol: %s", got)
+	}
+}
+
+func TestSetMaxDepth(t *testing.T) {
+	g := buildJSONParser()
+	g.SetMaxDepth(100)
+	if _, err := g.ParseString("test", strings.Repeat("[", 20)+strings.Repeat("]", 20)); err != nil {
+		t.Errorf("unexpected failure within the limit: %v", err)
+	}
+
+	deep := strings.Repeat("[", 100000) + strings.Repeat("]", 100000)
+	_, err := g.ParseString("test", deep)
+	if err == nil || !strings.HasSuffix(err.Error(), ": maximum nesting depth exceeded") {
+		t.Fatalf("expected the depth limit to be exceeded, got %v", err)
+	}
+	if loc := err.(*ParseError).Loc(); loc.Col > 100 {
+		t.Errorf("expected the error within the first 100 brackets, got %v", loc)
+	}
+
+	// The depth is back to zero for the next parse.
+	if _, err := g.ParseString("test", "[[1]]"); err != nil {
+		t.Errorf("unexpected failure: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package psec
+
+// The token layer: parsers which skip any whitespace following what they
+// match, so the rest of the grammar needn't mention whitespace at all.
+// What counts as whitespace is set per grammar, with SetWhitespace.
+
+// SetWhitespace sets the parser Lexeme, Tok and SpacedLiteral use to skip
+// whitespace. It should always succeed, typically by being a ManyDrop; its
+// value is ignored. The default is ManyDrop(OneOf(" \t\r\n")).
+// Including comments here lets the whole grammar skip them, eg.
+//
+//	g.SetWhitespace(ManyDrop(Alt(OneOf(" \t\r\n"), LineComment("//"))))
+func (g *Grammar) SetWhitespace(p Parser) {
+	g.whitespace = p
+}
+
+// Lexeme runs its inner parser and then skips any whitespace after it.
+// Its value is the inner parser's value.
+func Lexeme(p Parser) Parser {
+	return &pLexeme{p}
+}
+
+type pLexeme struct {
+	inner Parser
+}
+
+func (p *pLexeme) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	ps, err := p.inner.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	v := ps.Value()
+	ps, err = g.whitespace.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	return ps.SetValue(v), nil
+}
+
+func (p *pLexeme) describe() string {
+	return "Lexeme(" + describe(p.inner) + ")"
+}
+
+// Tok is a Literal which skips any whitespace after it.
+func Tok(str string) Parser {
+	return Lexeme(Literal(str))
+}
+
+// SpacedLiteral is a Literal which skips any whitespace both before and after
+// it, for operators like the + in "a + b" and "a+b" alike.
+// Its value is the literal string.
+func SpacedLiteral(str string) Parser {
+	return &pSpacedLiteral{Literal(str)}
+}
+
+type pSpacedLiteral struct {
+	lit Parser
+}
+
+func (p *pSpacedLiteral) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	ps, err := g.whitespace.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	ps, err = p.lit.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	v := ps.Value()
+	ps, err = g.whitespace.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	return ps.SetValue(v), nil
+}
+
+func (p *pSpacedLiteral) describe() string {
+	return "SpacedLiteral(" + describe(p.lit) + ")"
+}
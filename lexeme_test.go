@@ -0,0 +1,53 @@
+package psec
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLexeme(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("value", Alt(Lexeme(Integer()), Symbol("array")))
+	g.AddSymbol("array", Between(Tok("["), SepBy(Symbol("value"), Tok(",")), Tok("]")))
+	g.AddSymbol("START", Symbol("value"))
+
+	r, err := g.ParseString("test", "[1 , [2,3 ],\n\t[ ] ]  ")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if s := fmt.Sprint(r); s != "[1 [2 3] []]" {
+		t.Errorf("wrong result: %s", s)
+	}
+	expectValue(t, g, "7  ", 7)
+	expectErrorAt(t, g, "[1 2]", 3, "unclosed '[' opened at line 1 col 0, expected literal ']'")
+}
+
+func TestSetWhitespace(t *testing.T) {
+	g := NewGrammar()
+	g.SetWhitespace(ManyDrop(OneOf(" _")))
+	g.AddSymbol("START", Many(Tok("a")))
+	expectStrings(t, g, "a__a _ a", []string{"a", "a", "a"})
+	expectErrorAt(t, g, "a\na", 1, "incomplete parse, expected EOF but input remains: \na")
+}
+
+func TestSpacedLiteral(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Seq(Literal("a"), SpacedLiteral("+"), Literal("b")))
+	expectStrings(t, g, "a+b", []string{"a", "+", "b"})
+	expectStrings(t, g, "a  +  b", []string{"a", "+", "b"})
+	expectStrings(t, g, "a\n+\tb", []string{"a", "+", "b"})
+	expectErrorAt(t, g, "a  -  b", 3, "expected literal '+'")
+
+	g.AddSymbol("START", SpacedLiteral("+"))
+	expectString(t, g, "  +  ", "+")
+	expectString(t, g, "+", "+")
+}
+
+func TestSetWhitespaceComments(t *testing.T) {
+	g := NewGrammar()
+	g.SetWhitespace(ManyDrop(Alt(OneOf(" \t\r\n"), LineComment("//"))))
+	g.AddSymbol("START", Seq(Tok("a"), SpacedLiteral("+"), Lexeme(Literal("b"))))
+	expectStrings(t, g, "a // first\n// second\n+ // third\nb // last", []string{"a", "+", "b"})
+	expectStrings(t, g, "a+b", []string{"a", "+", "b"})
+	expectErrorAt(t, g, "a // + b", 8, "expected literal '+'")
+}
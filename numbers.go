@@ -0,0 +1,214 @@
+package psec
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// The built-in numeric parsers. Each matches the text of a number with
+// combinators, and converts it with strconv, so that out-of-range numbers are
+// reported as errors rather than silently wrapping.
+
+// concatText joins up the text matched by a tree of parser values: strings,
+// bytes and slices of them. nils are skipped, so Optional parts may be absent.
+func concatText(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case byte:
+		return string([]byte{v})
+	case []interface{}:
+		s := ""
+		for _, part := range v {
+			s += concatText(part)
+		}
+		return s
+	}
+	panic(fmt.Sprintf("concatText: unexpected %T", v))
+}
+
+func decimalDigits() Parser {
+	return Many1(Range('0', '9'))
+}
+
+// Integer parses a decimal integer with an optional sign, and its value is an
+// int. It fails if the number doesn't fit in an int.
+func Integer() Parser {
+	return MapLoc(Label("integer", Seq(Optional(OneOf("+-")), decimalDigits())),
+		func(res interface{}, loc *Loc) (interface{}, error) {
+			text := concatText(res)
+			n, err := strconv.Atoi(text)
+			if err != nil {
+				return nil, fmt.Errorf("integer %s out of range", text)
+			}
+			return n, nil
+		})
+}
+
+// Float parses a decimal floating-point number: an optional sign, digits, an
+// optional fraction and an optional exponent, eg. "-3.14e-2". Its value is a
+// float64. It fails if the number is too large for a float64.
+func Float() Parser {
+	return MapLoc(Label("number", Seq(
+		Optional(OneOf("+-")),
+		decimalDigits(),
+		Optional(Seq(Literal("."), decimalDigits())),
+		Optional(Seq(OneOf("eE"), Optional(OneOf("+-")), decimalDigits())))),
+		func(res interface{}, loc *Loc) (interface{}, error) {
+			text := concatText(res)
+			f, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("number %s out of range", text)
+			}
+			return f, nil
+		})
+}
+
+// HexInteger parses a hexadecimal integer with a 0x or 0X prefix, eg. "0xFF".
+// Its value is an int64. It fails if the number doesn't fit in an int64.
+func HexInteger() Parser {
+	hexDigit := Alt(Range('0', '9'), Range('a', 'f'), Range('A', 'F'))
+	return MapLoc(Label("hex integer", Seq(Alt(Literal("0x"), Literal("0X")), Many1(hexDigit))),
+		func(res interface{}, loc *Loc) (interface{}, error) {
+			digits := concatText(res.([]interface{})[1])
+			n, err := strconv.ParseInt(digits, 16, 64)
+			if err != nil {
+				return nil, fmt.Errorf("hex integer 0x%s out of range", digits)
+			}
+			return n, nil
+		})
+}
+
+// NumberOptions selects the syntax NumberLiteral accepts. The zero value
+// accepts only unsigned decimal integers.
+type NumberOptions struct {
+	Separators bool // Underscores between digits, eg. "1_000_000".
+	Signs      bool // A leading + or -.
+	Prefixes   bool // 0x, 0o and 0b for hex, octal and binary integers.
+	Floats     bool // Decimal fractions and exponents, eg. "3.5e2".
+}
+
+// NumberLiteral parses a number in the syntax chosen by opts. Its value is an
+// int64, or a float64 if it has a fraction or exponent. It fails if the number
+// is out of range, or if a separator isn't between two digits, eg. "1__0".
+// A "." or exponent not followed by digits is left unconsumed.
+func NumberLiteral(opts NumberOptions) Parser {
+	return &pNumberLiteral{opts}
+}
+
+type pNumberLiteral struct {
+	opts NumberOptions
+}
+
+func isOctalDigit(c byte) bool  { return '0' <= c && c <= '7' }
+func isBinaryDigit(c byte) bool { return c == '0' || c == '1' }
+
+// numberDigits parses one or more digits, and separators between them if
+// allowed, appending the digits to text. ps is nil if there are no digits.
+func (p *pNumberLiteral) numberDigits(ps Stream, text []byte, valid func(byte) bool) (Stream, []byte, *ParseError) {
+	if c, eof := ps.Head(); eof || !valid(c) {
+		return nil, text, nil
+	}
+	for {
+		c, eof := ps.Head()
+		switch {
+		case !eof && valid(c):
+			text = append(text, c)
+			ps = ps.Tail()
+		case !eof && c == '_' && p.opts.Separators:
+			if next, eof := ps.Tail().Head(); eof || !valid(next) {
+				return nil, text, ps.Loc().mkErrorMessage("malformed number, '_' must be between digits")
+			}
+			ps = ps.Tail()
+		default:
+			return ps, text, nil
+		}
+	}
+}
+
+func (p *pNumberLiteral) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
+	var text []byte
+	if c, eof := ps.Head(); !eof && p.opts.Signs && (c == '+' || c == '-') {
+		text = append(text, c)
+		ps = ps.Tail()
+	}
+
+	if p.opts.Prefixes {
+		base, valid := 0, isDigit
+		if c, eof := ps.Head(); !eof && c == '0' {
+			switch next, _ := ps.Tail().Head(); next {
+			case 'x', 'X':
+				base, valid = 16, isHexDigit
+			case 'o', 'O':
+				base, valid = 8, isOctalDigit
+			case 'b', 'B':
+				base, valid = 2, isBinaryDigit
+			}
+		}
+		if base != 0 {
+			prefix := ps
+			ps, text, err := p.numberDigits(ps.Tail().Tail(), text, valid)
+			if err != nil {
+				return nil, err
+			}
+			if ps == nil {
+				return nil, prefix.Loc().mkErrorMessage("malformed number, expected digits after %s", matchedText(prefix, prefix.Tail().Tail()))
+			}
+			n, e := strconv.ParseInt(string(text), base, 64)
+			if e != nil {
+				return nil, start.Loc().mkErrorMessage("integer %s out of range", matchedText(start, ps))
+			}
+			return ps.SetValue(n), nil
+		}
+	}
+
+	ps, text, err := p.numberDigits(ps, text, isDigit)
+	if err != nil {
+		return nil, err
+	}
+	if ps == nil {
+		return nil, start.Loc().mkErrorExpect("number")
+	}
+
+	float := false
+	if p.opts.Floats {
+		if c, eof := ps.Head(); !eof && c == '.' {
+			if frac, withFrac, err := p.numberDigits(ps.Tail(), append(text, '.'), isDigit); err != nil {
+				return nil, err
+			} else if frac != nil {
+				ps, text, float = frac, withFrac, true
+			}
+		}
+		if c, eof := ps.Head(); !eof && (c == 'e' || c == 'E') {
+			exp, withExp := ps.Tail(), append(text, 'e')
+			if c, eof := exp.Head(); !eof && (c == '+' || c == '-') {
+				exp, withExp = exp.Tail(), append(withExp, c)
+			}
+			if exp, withExp, err := p.numberDigits(exp, withExp, isDigit); err != nil {
+				return nil, err
+			} else if exp != nil {
+				ps, text, float = exp, withExp, true
+			}
+		}
+	}
+
+	if float {
+		f, e := strconv.ParseFloat(string(text), 64)
+		if e != nil {
+			return nil, start.Loc().mkErrorMessage("number %s out of range", matchedText(start, ps))
+		}
+		return ps.SetValue(f), nil
+	}
+	n, e := strconv.ParseInt(string(text), 10, 64)
+	if e != nil {
+		return nil, start.Loc().mkErrorMessage("integer %s out of range", matchedText(start, ps))
+	}
+	return ps.SetValue(n), nil
+}
+
+func (p *pNumberLiteral) describe() string {
+	return fmt.Sprintf("NumberLiteral(%+v)", p.opts)
+}
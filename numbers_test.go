@@ -0,0 +1,75 @@
+package psec
+
+import "testing"
+
+func expectValue(t *testing.T, g *Grammar, input string, expected interface{}) {
+	r, err := g.ParseString("test", input)
+	if err != nil {
+		t.Errorf("%q: unexpected failure: %v", input, err)
+		return
+	}
+	if r != expected {
+		t.Errorf("%q: expected %#v, got %#v", input, expected, r)
+	}
+}
+
+func TestInteger(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Integer())
+	expectValue(t, g, "42", 42)
+	expectValue(t, g, "-42", -42)
+	expectValue(t, g, "+7", 7)
+	expectError(t, g, "x", "expected integer")
+	expectError(t, g, "99999999999999999999", "integer 99999999999999999999 out of range")
+}
+
+func TestFloat(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Float())
+	expectValue(t, g, "3.14e-2", 0.0314)
+	expectValue(t, g, "-2.5", -2.5)
+	expectValue(t, g, "10", 10.0)
+	expectValue(t, g, "1E3", 1000.0)
+	expectError(t, g, ".5", "expected number")
+	expectError(t, g, "1e400", "number 1e400 out of range")
+}
+
+func TestHexInteger(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", HexInteger())
+	expectValue(t, g, "0xFF", int64(255))
+	expectValue(t, g, "0X7fffffffffffffff", int64(9223372036854775807))
+	expectError(t, g, "FF", "expected hex integer")
+	expectError(t, g, "0x10000000000000000", "hex integer 0x10000000000000000 out of range")
+}
+
+func TestNumberLiteral(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", NumberLiteral(NumberOptions{Separators: true, Signs: true, Prefixes: true, Floats: true}))
+	expectValue(t, g, "1_000", int64(1000))
+	expectValue(t, g, "+1_000_000", int64(1000000))
+	expectValue(t, g, "0b1010", int64(10))
+	expectValue(t, g, "-0xf_f", int64(-255))
+	expectValue(t, g, "0o17", int64(15))
+	expectValue(t, g, "-3.5e2", -350.0)
+	expectValue(t, g, "1_0.2_5", 10.25)
+	expectValue(t, g, "2E-2", 0.02)
+	expectValue(t, g, "0", int64(0))
+	expectErrorAt(t, g, "1__0", 1, "malformed number, '_' must be between digits")
+	expectErrorAt(t, g, "10_", 2, "malformed number, '_' must be between digits")
+	expectErrorAt(t, g, "0b102", 4, "incomplete parse, expected EOF but input remains: 2")
+	expectErrorAt(t, g, "1.", 1, "incomplete parse, expected EOF but input remains: .")
+	expectErrorAt(t, g, "1e", 1, "incomplete parse, expected EOF but input remains: e")
+	expectError(t, g, "0x", "malformed number, expected digits after 0x")
+	expectError(t, g, "_1", "expected number")
+	expectError(t, g, "9223372036854775808", "integer 9223372036854775808 out of range")
+	expectError(t, g, "1e400", "number 1e400 out of range")
+
+	// By default, only plain decimal integers.
+	g.AddSymbol("START", NumberLiteral(NumberOptions{}))
+	expectValue(t, g, "42", int64(42))
+	expectError(t, g, "-1", "expected number")
+	expectErrorAt(t, g, "1_0", 1, "incomplete parse, expected EOF but input remains: _0")
+	expectErrorAt(t, g, "0x1", 1, "incomplete parse, expected EOF but input remains: x1")
+	expectErrorAt(t, g, "1.5", 1, "incomplete parse, expected EOF but input remains: .5")
+}
@@ -1,43 +1,56 @@
 package psec
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
 )
 
 // Parser is the common interface for all parsers, which consume streams and
 // decorate them with values.
 type Parser interface {
-	// Parse consumes a Stream and symbolTable and returns a new Stream on success,
-	// and nil on failure.
-	Parse(Stream, symbolTable) (Stream, *parseError)
+	// Parse consumes a Stream and parseContext and returns a new Stream on
+	// success, and nil on failure.
+	Parse(Stream, *parseContext) (Stream, *ParseError)
 }
 
-type parseError struct {
+// ParseError is the error returned when parsing fails. It records where, and
+// what went wrong: a message, a set of alternatives that were expected, or both.
+type ParseError struct {
 	expected []string
 	message  string
 	loc      *Loc
+
+	// committed errors come from past a Cut, and so must not be backtracked
+	// over by Alt, Optional and friends.
+	committed bool
 }
 
-func (l *Loc) mkErrorExpectations(expected []string) *parseError {
-	return &parseError{
+func (l *Loc) mkErrorExpectations(expected []string) *ParseError {
+	return &ParseError{
 		expected: expected,
 		loc:      l,
 	}
 }
 
-func (l *Loc) mkErrorExpect(expect string, args ...interface{}) *parseError {
+func (l *Loc) mkErrorExpect(expect string, args ...interface{}) *ParseError {
 	return l.mkErrorExpectations([]string{fmt.Sprintf(expect, args...)})
 }
 
-func (l *Loc) mkErrorMessage(msg string, args ...interface{}) *parseError {
-	return &parseError{
+func (l *Loc) mkErrorMessage(msg string, args ...interface{}) *ParseError {
+	return &ParseError{
 		message: fmt.Sprintf(msg, args...),
 		loc:     l,
 	}
 }
 
-func (e *parseError) Error() string {
+func (e *ParseError) Error() string {
 	prefix := fmt.Sprintf("%s line %d col %d",
 		e.loc.Filename, e.loc.Line, e.loc.Col)
 
@@ -58,6 +71,50 @@ func (e *parseError) Error() string {
 	}
 }
 
+// Loc returns the location of the error.
+func (e *ParseError) Loc() *Loc { return e.loc }
+
+// Expected returns the descriptions of what was expected at the error's
+// location, eg. "literal 'x'". It is empty if there's only a message.
+func (e *ParseError) Expected() []string { return e.expected }
+
+// Message returns the error's message, without the location or expectations.
+// It may be empty if there are only expectations.
+func (e *ParseError) Message() string { return e.message }
+
+// FormatWithSource renders the error along with the line of src it refers to,
+// and a caret under the offending column:
+//
+//	test line 2 col 4: expected literal ')'
+//	foo(bar baz
+//	    ^
+//
+// src should be the whole input that was parsed. If the error's line isn't in
+// src, this is just Error().
+func (e *ParseError) FormatWithSource(src string) string {
+	lines := strings.Split(src, "\n")
+	if e.loc.Line < 1 || e.loc.Line > len(lines) {
+		return e.Error()
+	}
+	line := strings.TrimSuffix(lines[e.loc.Line-1], "\r")
+
+	// Pad up to the column, keeping any tabs so the caret lines up.
+	var pad strings.Builder
+	col := 0
+	for _, r := range line {
+		if col >= e.loc.Col {
+			break
+		}
+		if r == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteRune(' ')
+		}
+		col++
+	}
+	return fmt.Sprintf("%s\n%s\n%s^", e.Error(), line, pad.String())
+}
+
 // Action is a function type that adapts parser results from raw results to more
 // meaningful results, such as AST nodes.
 type Action func(results interface{}, loc *Loc) (interface{}, error)
@@ -65,27 +122,86 @@ type Action func(results interface{}, loc *Loc) (interface{}, error)
 // symbolTable maps rule names to their parsers.
 type symbolTable map[string]Parser
 
-// Stream is an abstract stream of bytes, with an optional value.
-// These are treated as immutable, so Tail() and SetValue() return new Streams.
+// parseContext is passed to every parser during a single top-level parse. It
+// holds the grammar's symbols, and any settings and bookkeeping for the parse.
+type parseContext struct {
+	symbols    symbolTable
+	whitespace Parser
+
+	trace      io.Writer
+	traceDepth int
+
+	// Errors caught by Recover, in the order they were found.
+	recovered []*ParseError
+
+	// The columns of the enclosing IndentMany blocks, innermost last.
+	indents []int
+
+	// Results of Memoize parsers, created on first use.
+	memo map[memoKey]memoResult
+
+	// The cross-parse cache, and which symbols use it.
+	cache  *Cache
+	cached map[string]bool
+
+	// Set if the grammar is compiled.
+	compiled *compiledGrammar
+
+	// For ParseStringContext: the context, how many symbols have been entered,
+	// and the context's error once the parse is aborted.
+	ctx     context.Context
+	steps   int
+	aborted error
+
+	// How deeply Symbols are nested, and the limit from SetMaxDepth.
+	depth, maxDepth int
+}
+
+// Stream is an abstract stream of bytes, with an optional value and user state.
+// These are treated as immutable, so Tail(), SetValue() and SetState() return
+// new Streams. Unlike the value, the state is carried along by Tail().
 type Stream interface {
 	Head() (byte, bool) // Returns (b, false) or (0, true) at EOF.
 	Tail() Stream
 	Value() interface{}
 	SetValue(interface{}) Stream
+	State() interface{}
+	SetState(interface{}) Stream
 	Loc() *Loc
+	Offset() int // The number of bytes consumed before this point.
 	RemainingInput() string
 }
 
+// Loc is a position in the input. Line is 1-based, and Col is the 0-based
+// count of runes (not bytes) since the start of the line. Offset is the 0-based
+// byte offset from the start of the input.
 type Loc struct {
 	Filename string
 	Line     int
 	Col      int
+	Offset   int
 }
 
 func (l *Loc) String() string {
 	return fmt.Sprintf("%s line %d col %d", l.Filename, l.Line, l.Col)
 }
 
+// Compare orders two locations in the same file, returning -1 if l comes
+// before other, 1 if it comes after, and 0 if they're the same position.
+func (l *Loc) Compare(other *Loc) int {
+	switch {
+	case l.Line < other.Line:
+		return -1
+	case l.Line > other.Line:
+		return 1
+	case l.Col < other.Col:
+		return -1
+	case l.Col > other.Col:
+		return 1
+	}
+	return 0
+}
+
 // The string is immutable and we have an index into it.
 // The value might be nil, but it might also be some other value.
 // stringPS is treated as immutable; that's why Tail() and SetValue()
@@ -97,7 +213,37 @@ type stringPS struct {
 	line     int
 	col      int
 	value    interface{}
+	state    interface{}
 	tail     *stringPS
+	arena    *streamArena
+}
+
+// streamArena hands out stringPS structs carved from shared slabs, so that a
+// parse costs one allocation per slab rather than one per stream. All the
+// streams of one parse share an arena; a nil arena allocates them singly.
+type streamArena struct {
+	slab []stringPS
+	next int // Size of the next slab; they double up to maxStreamSlab.
+}
+
+const maxStreamSlab = 256
+
+func (a *streamArena) alloc() *stringPS {
+	if a == nil {
+		return new(stringPS)
+	}
+	if len(a.slab) == 0 {
+		if a.next < 16 {
+			a.next = 16
+		}
+		a.slab = make([]stringPS, a.next)
+		if a.next < maxStreamSlab {
+			a.next *= 2
+		}
+	}
+	s := &a.slab[0]
+	a.slab = a.slab[1:]
+	return s
 }
 
 func (s *stringPS) Head() (byte, bool) {
@@ -109,70 +255,111 @@ func (s *stringPS) Head() (byte, bool) {
 
 func (s *stringPS) Tail() Stream {
 	if s.tail == nil {
-		s.tail = &stringPS{
+		s.tail = s.arena.alloc()
+		*s.tail = stringPS{
 			str:      s.str,
 			pos:      s.pos + 1,
 			filename: s.filename,
-			line:     s.line,
-			col:      s.col,
-		}
-
-		// If the character we just skipped was a newline, bump the line.
-		if s.str[s.pos] == '\n' {
-			s.tail.line = s.line + 1
-			s.tail.col = 0
+			state:    s.state,
+			arena:    s.arena,
 		}
+		s.tail.line, s.tail.col = advanceLoc(s.line, s.col, s.str[s.pos])
 	}
 	return s.tail
 }
+
+// advanceLoc computes the line and column following the character c.
+func advanceLoc(line, col int, c byte) (int, int) {
+	// If the character we just skipped was a newline, bump the line.
+	// Columns count runes, so UTF-8 continuation bytes don't advance them.
+	if c == '\n' {
+		return line + 1, 0
+	} else if utf8.RuneStart(c) {
+		return line, col + 1
+	}
+	return line, col
+}
 func (s *stringPS) Value() interface{} { return s.value }
 func (s *stringPS) SetValue(v interface{}) Stream {
-	dup := *s
+	dup := s.arena.alloc()
+	*dup = *s
 	dup.value = v
-	return &dup
+	return dup
+}
+
+func (s *stringPS) State() interface{} { return s.state }
+func (s *stringPS) SetState(st interface{}) Stream {
+	dup := s.arena.alloc()
+	*dup = *s
+	dup.state = st
+	dup.tail = nil // The cached tail carries the old state.
+	return dup
 }
 
 func (s *stringPS) Loc() *Loc {
-	return &Loc{Filename: s.filename, Line: s.line, Col: s.col}
+	return &Loc{Filename: s.filename, Line: s.line, Col: s.col, Offset: int(s.pos)}
 }
 
+func (s *stringPS) Offset() int { return int(s.pos) }
+
 func (s *stringPS) RemainingInput() string {
 	return s.str[s.pos:]
 }
 
+func (s *stringPS) textTo(to Stream) string {
+	return s.str[s.pos:to.Offset()]
+}
+
 // The built-in Parsers themselves.
 
 // Literal parses a given string exactly, matching case.
 // The parser's value is the string itself.
 // See LiteralIC for case-insensitive.
 func Literal(str string) Parser {
-	return &pLiteral{str}
+	return &pLiteral{str, str, fmt.Sprintf("literal '%s'", str)}
+}
+
+// LiteralValue is a variant of Literal whose value is value, rather than the
+// string, eg. LiteralValue("true", true).
+func LiteralValue(str string, value interface{}) Parser {
+	return &pLiteral{str, value, fmt.Sprintf("literal '%s'", str)}
 }
 
 type pLiteral struct {
 	target string
+	value  interface{}
+	expect string // Formatted once, since literals fail all the time.
 }
 
-func (p *pLiteral) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
+func (p *pLiteral) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
 	i := 0
 	for i < len(p.target) {
 		h, eof := ps.Head()
 		if eof || p.target[i] != h {
-			return nil, ps.Loc().mkErrorExpect("literal '%s'", p.target)
+			return nil, start.Loc().mkErrorExpectations([]string{p.expect})
 		}
 		ps = ps.Tail()
 		i++
 	}
-	return ps.SetValue(p.target), nil
+	return ps.SetValue(p.value), nil
 }
 
-// TODO: Literal with value? I don't know how often that's actually used.
+func (p *pLiteral) describe() string {
+	return fmt.Sprintf("%q", p.target)
+}
 
 // LiteralIC parses a given string, ignoring case.
 // The parser's value is the *original, canonical string*. (That is, the string
 // passed to LiteralIC, not the capitalization in the input string.)
+// Only ASCII letters are matched case-insensitively; any other bytes, including
+// those of non-ASCII characters, must match exactly.
 func LiteralIC(str string) Parser {
-	return &pLiteralIC{str, strings.ToUpper(str)}
+	up := make([]byte, len(str))
+	for i := 0; i < len(str); i++ {
+		up[i] = upperASCII(str[i])
+	}
+	return &pLiteralIC{str, string(up)}
 }
 
 type pLiteralIC struct {
@@ -180,63 +367,196 @@ type pLiteralIC struct {
 	upcased string
 }
 
-func (p *pLiteralIC) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
-	for i := 0; i < len(p.target); i++ {
+func upperASCII(c byte) byte {
+	if 'a' <= c && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
+
+func (p *pLiteralIC) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
+	for i := 0; i < len(p.upcased); i++ {
 		h, eof := ps.Head()
-		if eof || p.upcased[i] != strings.ToUpper(string(h))[0] {
-			return nil, ps.Loc().mkErrorExpect("literal '%s'", p.target)
+		if eof || p.upcased[i] != upperASCII(h) {
+			return nil, start.Loc().mkErrorExpect("literal '%s'", p.target)
 		}
 		ps = ps.Tail()
 	}
 	return ps.SetValue(p.target), nil
 }
 
+func (p *pLiteralIC) describe() string {
+	return fmt.Sprintf("%qi", p.target)
+}
+
 // Alt accepts any number of parsers. It tries each one in turn. The first
 // one to succeed becomes the resulting parse. If none of the parsers succeeds
 // (or none are provided), Alt fails.
 func Alt(parsers ...Parser) Parser {
-	return &pAlt{parsers}
+	return &pAlt{parsers, false}
+}
+
+// AltVerbose is a debugging variant of Alt. When every branch fails, its error
+// lists each branch's own error, with its location, on a line of its own.
+func AltVerbose(parsers ...Parser) Parser {
+	return &pAlt{parsers, true}
 }
 
 type pAlt struct {
 	parsers []Parser
+	verbose bool
 }
 
-func (p *pAlt) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
-	var errs []*parseError
+func (p *pAlt) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	var errs []*ParseError
 	for _, inner := range p.parsers {
 		ret, err := inner.Parse(ps, g)
 		if ret != nil {
 			return ret, nil
 		}
+		if err.committed {
+			return nil, err
+		}
 		errs = append(errs, err)
 	}
 
-	// We combine all the expectations of the inner errors together.
-	var exps []string
+	if p.verbose {
+		var sb strings.Builder
+		sb.WriteString("no alternative matched:")
+		for i, err := range errs {
+			fmt.Fprintf(&sb, "\n\t%d: %s", i+1, err.Error())
+		}
+		return nil, ps.Loc().mkErrorMessage("%s", sb.String())
+	}
+
+	// The most useful error comes from whichever branch got furthest before
+	// failing. If that's only one branch, its error stands as is.
+	// We combine the expectations of all the inner errors that tie.
+	start := ps.Loc()
+	furthest := start
+	count := 0
+	for _, err := range errs {
+		if c := err.loc.Compare(furthest); c > 0 {
+			furthest = err.loc
+			count = 1
+		} else if c == 0 {
+			count++
+		}
+	}
+	if count == 1 && furthest != start {
+		for _, err := range errs {
+			if err.loc.Compare(furthest) == 0 {
+				return nil, err
+			}
+		}
+	}
+
+	// Branches which only give a message, like OneOf, have no expectations to
+	// merge, so their messages are kept too.
+	var exps, msgs []string
 	for _, err := range errs {
-		exps = append(exps, err.expected...)
+		if err.loc.Compare(furthest) == 0 {
+			exps = append(exps, err.expected...)
+			if len(err.expected) == 0 && err.message != "" && !containsString(msgs, err.message) {
+				msgs = append(msgs, err.message)
+			}
+		}
 	}
 	//fmt.Printf("psec: alt errors %#v\n", exps)
-	retErr := ps.Loc().mkErrorExpectations(exps)
+	retErr := furthest.mkErrorExpectations(exps)
+	retErr.message = strings.Join(msgs, "; ")
 	//fmt.Printf("psec:     %v", retErr)
 	return nil, retErr
 }
 
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *pAlt) describe() string {
+	// Alternatives bind loosest, so they never need parentheses.
+	parts := make([]string, len(p.parsers))
+	for i, inner := range p.parsers {
+		parts[i] = describe(inner)
+	}
+	return strings.Join(parts, " | ")
+}
+
+// Dispatch looks at the next byte, without consuming it, and runs only the
+// parser for it in table, or fallback if the byte isn't in table. It's a faster
+// Alt for when each alternative can be told apart by its first byte, like the
+// values in JSON. If fallback is nil, other bytes are an error.
+func Dispatch(table map[byte]Parser, fallback Parser) Parser {
+	keys := make([]byte, 0, len(table))
+	for c := range table {
+		keys = append(keys, c)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return &pDispatch{table, fallback, string(keys)}
+}
+
+type pDispatch struct {
+	table    map[byte]Parser
+	fallback Parser
+	keys     string // The bytes in table, in order, for errors.
+}
+
+func (p *pDispatch) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	c, eof := ps.Head()
+	if !eof {
+		if inner, ok := p.table[c]; ok {
+			return inner.Parse(ps, g)
+		}
+	}
+	if p.fallback != nil {
+		return p.fallback.Parse(ps, g)
+	}
+	if eof {
+		return nil, ps.Loc().mkErrorMessage("unexpected EOF, expected one of '%s'", p.keys)
+	}
+	return nil, ps.Loc().mkErrorMessage("expected one of: %s", p.keys)
+}
+
+func (p *pDispatch) describe() string {
+	parts := make([]string, 0, len(p.keys)+1)
+	for i := 0; i < len(p.keys); i++ {
+		parts = append(parts, fmt.Sprintf("%q: %s", string(p.keys[i]), describe(p.table[p.keys[i]])))
+	}
+	if p.fallback != nil {
+		parts = append(parts, "else: "+describe(p.fallback))
+	}
+	return "Dispatch(" + strings.Join(parts, ", ") + ")"
+}
+
 // Seq runs an list of parsers in order, one after the other.
 // If each parser succeeds, returns an array of their values.
 // If any child parser fails, so does Seq.
 func Seq(parsers ...Parser) Parser {
-	return &pSeq{parsers}
+	return &pSeq{parsers, hasManyLazy(parsers)}
 }
 
 type pSeq struct {
 	parsers []Parser
+	lazy    bool // Whether any of the parsers is a ManyLazy.
 }
 
-func (p *pSeq) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
+func (p *pSeq) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
 	out := make([]interface{}, len(p.parsers))
-	var err *parseError
+	if p.lazy {
+		ps, err := seqLazy(ps, p.parsers, out, g)
+		if err != nil {
+			return nil, err
+		}
+		return ps.SetValue(out), nil
+	}
+
+	var err *ParseError
 	for i, inner := range p.parsers {
 		ps, err = inner.Parse(ps, g)
 		if err != nil {
@@ -247,21 +567,44 @@ func (p *pSeq) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
 	return ps.SetValue(out), nil
 }
 
+func (p *pSeq) describe() string {
+	return describeSeq(p.parsers)
+}
+
+// SeqMap runs a list of parsers in order, like Seq, and then passes their
+// values to build as separate arguments. Its value is build's result. If build
+// returns an error, SeqMap fails with it, as with Map.
+func SeqMap(build func(vs ...interface{}) (interface{}, error), parsers ...Parser) Parser {
+	return Map(Seq(parsers...), func(v interface{}, loc *Loc) (interface{}, error) {
+		return build(v.([]interface{})...)
+	})
+}
+
 // SeqAt runs a list of parsers in order, one after the other.
 // It takes an index (0-based), and its value is the value of that parser.
 // If any of the parsers fails, so does SeqAt.
 func SeqAt(index int, parsers ...Parser) Parser {
-	return &pSeqAt{parsers, index}
+	return &pSeqAt{parsers, index, hasManyLazy(parsers)}
 }
 
 type pSeqAt struct {
 	parsers []Parser
 	index   int
+	lazy    bool
 }
 
-func (p *pSeqAt) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
+func (p *pSeqAt) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	if p.lazy {
+		out := make([]interface{}, len(p.parsers))
+		ps, err := seqLazy(ps, p.parsers, out, g)
+		if err != nil {
+			return nil, err
+		}
+		return ps.SetValue(out[p.index]), nil
+	}
+
 	var v interface{}
-	var err *parseError
+	var err *ParseError
 	for i, inner := range p.parsers {
 		ps, err = inner.Parse(ps, g)
 		if err != nil {
@@ -274,221 +617,1209 @@ func (p *pSeqAt) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
 	return ps.SetValue(v), nil
 }
 
-// Stringify wraps another parser, and combines its output (which should be a
-// []byte) into a single string.
-func Stringify(p Parser) Parser {
-	return parserWithAction(p, func(raw interface{}, loc *Loc) (interface{}, error) {
-		res := raw.([]interface{})
-		out := make([]byte, len(res))
-		for i, c := range res {
-			out[i] = c.(byte)
-		}
-		return string(out), nil
-	})
+func (p *pSeqAt) describe() string {
+	return describeSeq(p.parsers)
 }
 
-// Optional attempts to run its inner parser. If that parser succeeds, Optional
-// succeeds with its value. If the inner parser fails, Optional succeeds with
-// value nil, and without consuming any input.
-func Optional(p Parser) Parser {
-	return &pOptional{p}
+// ManyLazy matches 0 or more of its inner parser, like Many, but as few as
+// possible: as part of a Seq or SeqAt, it first tries the rest of the sequence
+// with no items, and only if that fails does it match one more item and try
+// again. Its value is the list of the items' values.
+// For example, Seq(ManyLazy(AnyChar()), Literal("-->")) stops at the first
+// "-->", where Many would run to the end of the input and fail.
+// Only the rest of its own Seq is considered, not what follows an enclosing
+// parser. It must be a direct member of the Seq, SeqAt or Between: wrapped in
+// another parser, such as Stringify or a Symbol, it can't see what follows it,
+// and so fails with a committed error, as for a mistake in the grammar.
+func ManyLazy(p Parser) Parser {
+	return &pManyLazy{p}
 }
 
-type pOptional struct {
+type pManyLazy struct {
 	inner Parser
 }
 
-func (p *pOptional) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
-	res, _ := p.inner.Parse(ps, g)
-	if res != nil {
-		return res, nil
-	}
-	return ps.SetValue(nil), nil
+func (p *pManyLazy) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	// Seq, SeqAt and Between call parseThen instead, so getting here means
+	// it's been wrapped, and would silently match nothing.
+	err := ps.Loc().mkErrorMessage("%s must be directly inside a Seq, SeqAt or Between", p.describe())
+	err.committed = true
+	return nil, err
 }
 
-// AnyChar parses any single character, returning it as the value.
-func AnyChar() Parser {
-	return &anyCharSingleton
+func (p *pManyLazy) describe() string {
+	return describeTerm(p.inner) + "*?"
 }
 
-type pAnyChar struct{}
-
-var anyCharSingleton pAnyChar
+// parseThen matches as few items as it can such that rest then succeeds,
+// storing its own value in out[0] and rest's in the remainder of out.
+func (p *pManyLazy) parseThen(ps Stream, rest []Parser, out []interface{}, g *parseContext) (Stream, *ParseError) {
+	items := make([]interface{}, 0)
+	for {
+		out[0] = items
+		end, err := seqLazy(ps, rest, out[1:], g)
+		if err == nil || err.committed {
+			return end, err
+		}
 
-func (p *pAnyChar) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
-	c, eof := ps.Head()
-	if eof {
-		return nil, ps.Loc().mkErrorMessage("unexpected EOF")
+		next, e := p.inner.Parse(ps, g)
+		if e != nil {
+			if e.committed {
+				return nil, e
+			}
+			// Out of items, so the reason rest failed is the better error.
+			return nil, err
+		}
+		if next.Offset() == ps.Offset() {
+			// An item that consumes nothing would keep us here forever.
+			return nil, err
+		}
+		items = append(items, next.Value())
+		ps = next
 	}
-	return ps.Tail().SetValue(c), nil
-}
-
-// OneOf matches any single character from a string of possibilities.
-// Its value is that single character as a byte.
-func OneOf(options string) Parser {
-	return &pOneOf{options}
 }
 
-type pOneOf struct {
-	options string
+func hasManyLazy(parsers []Parser) bool {
+	for _, p := range parsers {
+		if _, ok := p.(*pManyLazy); ok {
+			return true
+		}
+	}
+	return false
 }
 
-func (p *pOneOf) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
-	c, eof := ps.Head()
-	if eof {
-		return nil, ps.Loc().mkErrorMessage("unexpected EOF, expected one of '%s'", p.options)
-	}
-	for i := 0; i < len(p.options); i++ {
-		if c == p.options[i] {
-			return ps.Tail().SetValue(c), nil
+// seqLazy runs parsers in order, like Seq, storing their values in out. At a
+// ManyLazy, it hands the rest of the sequence over to it.
+func seqLazy(ps Stream, parsers []Parser, out []interface{}, g *parseContext) (Stream, *ParseError) {
+	var err *ParseError
+	for i, inner := range parsers {
+		if lazy, ok := inner.(*pManyLazy); ok {
+			return lazy.parseThen(ps, parsers[i+1:], out[i:], g)
+		}
+		ps, err = inner.Parse(ps, g)
+		if err != nil {
+			return nil, err
 		}
+		out[i] = ps.Value()
 	}
-	return nil, ps.Loc().mkErrorMessage("expected one of: %s", p.options)
+	return ps, nil
 }
 
-// NoneOf matches any single character NOT in a "blacklist" string.
-// Its value is the single character as a byte.
-func NoneOf(blacklist string) Parser {
-	return &pNoneOf{blacklist}
+// Between runs open, inner and close in order, and its value is the value of
+// inner. If any of the three fails, so does Between.
+// It is like SeqAt(1, open, inner, close), except that a missing close is
+// reported as an unclosed open, with the open's location, as for Nested.
+func Between(open, inner, close Parser) Parser {
+	return &pBetween{open, inner, close}
 }
 
-type pNoneOf struct {
-	blacklist string
+type pBetween struct {
+	open, inner, close Parser
 }
 
-func (p *pNoneOf) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
-	c, eof := ps.Head()
-	if eof {
-		return nil, ps.Loc().mkErrorMessage("unexpected EOF")
+func (p *pBetween) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
+	ps, err := p.open.Parse(ps, g)
+	if err != nil {
+		return nil, err
 	}
-	for i := 0; i < len(p.blacklist); i++ {
-		if c == p.blacklist[i] {
-			return nil, ps.Loc().mkErrorMessage("unexpected %c", c)
+	body := ps
+
+	if lazy, ok := p.inner.(*pManyLazy); ok {
+		out := make([]interface{}, 2)
+		end, err := lazy.parseThen(ps, []Parser{p.close}, out, g)
+		if err != nil {
+			if err.committed {
+				return nil, err
+			}
+			return nil, unclosedError(start, matchedText(start, body), err)
 		}
+		return end.SetValue(out[0]), nil
 	}
-	return ps.Tail().SetValue(c), nil
-}
-
-// Range takes two characters (bytes) and parses any character in that range
-// (inclusive).
-// For example, given 'a' and 'z', parses any lowercase letter.
-// Value is the parsed character. Fails on EOF.
-func Range(lo, hi byte) Parser {
-	return &pRange{lo, hi}
-}
-
-type pRange struct {
-	lo, hi byte
-}
 
-func (p *pRange) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
-	c, eof := ps.Head()
-	if !eof && p.lo <= c && c <= p.hi {
-		return ps.Tail().SetValue(c), nil
+	ps, err = p.inner.Parse(ps, g)
+	if err != nil {
+		return nil, err
 	}
-	return nil, ps.Loc().mkErrorExpect("range(%c..%c)", p.lo, p.hi)
+	v := ps.Value()
+	ps, err = p.close.Parse(ps, g)
+	if err != nil {
+		if err.committed {
+			return nil, err
+		}
+		return nil, unclosedError(start, matchedText(start, body), err)
+	}
+	return ps.SetValue(v), nil
 }
 
-// Many parses 0 or more copies of its inner parser, returning an array of its
-// results.
-func Many(p Parser) Parser {
-	return ManyMin(p, 0)
+func (p *pBetween) describe() string {
+	return describeSeq([]Parser{p.open, p.inner, p.close})
 }
 
-// Many1 is a variant of Many that parses 1 or more copies.
-func Many1(p Parser) Parser {
-	return ManyMin(p, 1)
+// Skip runs skip and then keep, and its value is keep's value.
+// It is equivalent to SeqAt(1, skip, keep).
+func Skip(skip, keep Parser) Parser {
+	return SeqAt(1, skip, keep)
 }
 
-// ManyMin is a variant of Many with a user-defined minimum.
-func ManyMin(p Parser, min int) Parser {
-	return &pMany{p, min, true}
+// Then runs keep and then skip, and its value is keep's value.
+// It is equivalent to SeqAt(0, keep, skip).
+func Then(keep, skip Parser) Parser {
+	return SeqAt(0, keep, skip)
 }
 
-// ManyDrop parses 0 or more copies, but discards the results rather than
-// building an array.
-func ManyDrop(p Parser) Parser {
-	return &pMany{p, 0, false}
+// Nested matches balanced, nested delimiters: open, then any mix of content and
+// further Nested groups, then close. Its value is a slice of the content values,
+// with each nested group as a slice of its own, so "((a)(b))" yields
+// [[a] [b]].
+// A missing close is reported as an unclosed open, with the open's location.
+func Nested(open, close, content Parser) Parser {
+	return &pNested{open, close, content}
 }
 
-type pMany struct {
-	inner   Parser
-	min     int
-	capture bool
+type pNested struct {
+	open, close, content Parser
 }
 
-// Combined parser for the different flavours of Many.
-func (p *pMany) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
-	var results []interface{}
-	if p.capture {
-		results = make([]interface{}, 0)
+func (p *pNested) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
+	ps, err := p.open.Parse(ps, g)
+	if err != nil {
+		return nil, err
 	}
+	body := ps
 
-	found := 0
-	var ps2 Stream
-	var err *parseError
+	items := make([]interface{}, 0)
 	for {
-		ps2, err = p.inner.Parse(ps, g)
-		if err != nil {
-			break
+		cps, cerr := p.close.Parse(ps, g)
+		if cerr == nil {
+			return cps.SetValue(items), nil
 		}
-		found++
-		if p.capture {
-			results = append(results, ps2.Value())
+		if cerr.committed {
+			return nil, cerr
 		}
-		ps = ps2
-	}
 
-	// Check that we've got at least min results.
-	if found < p.min {
-		return nil, &parseError{
-			loc:      ps.Loc(),
-			message:  fmt.Sprintf("minimum %d", p.min),
-			expected: err.expected,
+		if _, err := p.open.Parse(ps, g); err == nil {
+			ps, err = p.Parse(ps, g)
+			if err != nil {
+				return nil, err
+			}
+		} else if ips, err := p.content.Parse(ps, g); err == nil {
+			ps = ips
+		} else if err.committed {
+			return nil, err
+		} else {
+			return nil, unclosedError(start, matchedText(start, body), cerr)
 		}
+		items = append(items, ps.Value())
 	}
+}
 
-	// Good to return.
-	if p.capture {
-		return ps.SetValue(results), nil
-	}
-	return ps.SetValue(nil), nil
+func (p *pNested) describe() string {
+	return fmt.Sprintf("Nested(%s, %s, %s)", describe(p.open), describe(p.close), describe(p.content))
 }
 
-// SepBy matches 0 or more of one parser, separated by a second parser.
-// The value is a list of the first parser's results.
-// Does NOT consume a trailing separator.
-func SepBy(p, sep Parser) Parser {
-	return &pSepBy{p, sep, 0}
+// textSlicer is implemented by streams which can return the input between two
+// of their positions directly, without building all of RemainingInput.
+type textSlicer interface {
+	// textTo returns the input from this stream's position to to's, which must
+	// be a later position in the same input.
+	textTo(to Stream) string
 }
 
-// SepBy1 matches 1 or more of one parser, separated by a second parser.
+// ender is implemented by streams whose Head doesn't show whether all the input
+// has been used, such as token streams, which hide their tokens from parsers
+// for bytes.
+type ender interface {
+	atEnd() bool
+}
+
+// atEnd reports whether all of the stream's input has been consumed.
+func atEnd(ps Stream) bool {
+	if e, ok := ps.(ender); ok {
+		return e.atEnd()
+	}
+	_, eof := ps.Head()
+	return eof
+}
+
+// matchedText returns the input consumed between two streams.
+func matchedText(from, to Stream) string {
+	if s, ok := from.(textSlicer); ok {
+		return s.textTo(to)
+	}
+	return from.RemainingInput()[:to.Offset()-from.Offset()]
+}
+
+// unclosedError reports that the closing delimiter for opened, which began at
+// open, was expected but failed with closeErr. Any whitespace the opening
+// delimiter skipped is left out of the message.
+func unclosedError(open Stream, opened string, closeErr *ParseError) *ParseError {
+	loc := open.Loc()
+	return &ParseError{
+		loc: closeErr.loc,
+		message: fmt.Sprintf("unclosed '%s' opened at line %d col %d",
+			strings.TrimRight(opened, " \t\r\n"), loc.Line, loc.Col),
+		expected: closeErr.expected,
+	}
+}
+
+// Captured runs its inner parser, and its value is the exact input the inner
+// parser consumed, as a string, whatever the inner parser's own value was.
+func Captured(p Parser) Parser {
+	return &pCaptured{p}
+}
+
+type pCaptured struct {
+	inner Parser
+}
+
+func (p *pCaptured) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	res, err := p.inner.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	return res.SetValue(matchedText(ps, res)), nil
+}
+
+func (p *pCaptured) describe() string {
+	return "Captured(" + describe(p.inner) + ")"
+}
+
+// Span is the value of WithSpan: the inner parser's value, the input it
+// consumed, and where that input starts and ends. End is the location just
+// after the last character consumed.
+type Span struct {
+	Value      interface{}
+	Text       string
+	Start, End *Loc
+}
+
+// WithSpan runs its inner parser, and its value is a Span recording both the
+// inner parser's value and the source text it matched.
+func WithSpan(p Parser) Parser {
+	return &pWithSpan{p}
+}
+
+type pWithSpan struct {
+	inner Parser
+}
+
+func (p *pWithSpan) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	res, err := p.inner.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	return res.SetValue(Span{res.Value(), matchedText(ps, res), ps.Loc(), res.Loc()}), nil
+}
+
+func (p *pWithSpan) describe() string {
+	return "WithSpan(" + describe(p.inner) + ")"
+}
+
+// Stringify wraps another parser, and combines its output (which should be a
+// slice of bytes or runes) into a single string.
+func Stringify(p Parser) Parser {
+	return Map(p, func(raw interface{}, loc *Loc) (interface{}, error) {
+		return string(collectBytes(raw)), nil
+	})
+}
+
+// Bytes is a variant of Stringify whose value is a []byte rather than a
+// string, for binary formats that shouldn't be treated as text.
+func Bytes(p Parser) Parser {
+	return Map(p, func(raw interface{}, loc *Loc) (interface{}, error) {
+		return collectBytes(raw), nil
+	})
+}
+
+// collectBytes combines a slice of bytes or runes, as for Stringify, encoding
+// any runes as UTF-8.
+func collectBytes(raw interface{}) []byte {
+	res := raw.([]interface{})
+	out := make([]byte, 0, len(res))
+	for _, c := range res {
+		if r, ok := c.(rune); ok {
+			out = utf8.AppendRune(out, r)
+		} else {
+			out = append(out, c.(byte))
+		}
+	}
+	return out
+}
+
+// Optional attempts to run its inner parser. If that parser succeeds, Optional
+// succeeds with its value. If the inner parser fails, Optional succeeds with
+// value nil, and without consuming any input.
+func Optional(p Parser) Parser {
+	return &pOptional{p, nil}
+}
+
+// OptionDefault is a variant of Optional whose value is def, rather than nil,
+// when the inner parser fails.
+func OptionDefault(def interface{}, p Parser) Parser {
+	return &pOptional{p, def}
+}
+
+type pOptional struct {
+	inner      Parser
+	defaultVal interface{}
+}
+
+func (p *pOptional) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	res, err := p.inner.Parse(ps, g)
+	if res != nil {
+		return res, nil
+	}
+	if err.committed {
+		return nil, err
+	}
+	return ps.SetValue(p.defaultVal), nil
+}
+
+func (p *pOptional) describe() string {
+	return describeTerm(p.inner) + "?"
+}
+
+// MaybeValue is the value of Maybe: whether its inner parser matched, and if
+// so, the inner parser's value.
+type MaybeValue struct {
+	Present bool
+	Value   interface{}
+}
+
+// Maybe is a variant of Optional whose value is a MaybeValue, so that a match
+// whose value is nil can be told apart from no match at all.
+func Maybe(p Parser) Parser {
+	return &pMaybe{p}
+}
+
+type pMaybe struct {
+	inner Parser
+}
+
+func (p *pMaybe) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	res, err := p.inner.Parse(ps, g)
+	if res != nil {
+		return res.SetValue(MaybeValue{true, res.Value()}), nil
+	}
+	if err.committed {
+		return nil, err
+	}
+	return ps.SetValue(MaybeValue{}), nil
+}
+
+func (p *pMaybe) describe() string {
+	return describeTerm(p.inner) + "?"
+}
+
+// Pure always succeeds with the value v, without consuming any input.
+func Pure(v interface{}) Parser {
+	return &pPure{v}
+}
+
+type pPure struct {
+	value interface{}
+}
+
+func (p *pPure) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	return ps.SetValue(p.value), nil
+}
+
+func (p *pPure) describe() string {
+	return fmt.Sprintf("Pure(%v)", p.value)
+}
+
+// Fail always fails with the given message, formatted as with fmt.Sprintf.
+func Fail(msg string, args ...interface{}) Parser {
+	return &pFail{fmt.Sprintf(msg, args...)}
+}
+
+type pFail struct {
+	message string
+}
+
+func (p *pFail) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	return nil, ps.Loc().mkErrorMessage("%s", p.message)
+}
+
+func (p *pFail) describe() string {
+	return fmt.Sprintf("Fail(%q)", p.message)
+}
+
+// LookAhead runs its inner parser, and if it succeeds, LookAhead succeeds with
+// its value but without consuming any input. If the inner parser fails, so
+// does LookAhead.
+// Compare Optional, which never fails.
+func LookAhead(p Parser) Parser {
+	return &pLookAhead{p}
+}
+
+type pLookAhead struct {
+	inner Parser
+}
+
+func (p *pLookAhead) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	res, err := p.inner.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	return ps.SetValue(res.Value()), nil
+}
+
+func (p *pLookAhead) describe() string {
+	return "&" + describeTerm(p.inner)
+}
+
+// NotFollowedBy succeeds only when its inner parser fails. It never consumes
+// any input, and its value is nil. If the inner parser succeeds, NotFollowedBy
+// fails, reporting the input the inner parser matched as unexpected.
+func NotFollowedBy(p Parser) Parser {
+	return &pNotFollowedBy{p}
+}
+
+type pNotFollowedBy struct {
+	inner Parser
+}
+
+func (p *pNotFollowedBy) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	res, _ := p.inner.Parse(ps, g)
+	if res == nil {
+		return ps.SetValue(nil), nil
+	}
+	return nil, ps.Loc().mkErrorMessage("unexpected %s", matchedText(ps, res))
+}
+
+func (p *pNotFollowedBy) describe() string {
+	return "!" + describeTerm(p.inner)
+}
+
+// Keyword matches word, but only as a whole word: not when it is immediately
+// followed by something cont accepts, typically an identifier character.
+// For example, Keyword("if", AlphaNum()) matches "if (" but not "iffy".
+// Its value is the keyword.
+func Keyword(word string, cont Parser) Parser {
+	return Label(fmt.Sprintf("keyword '%s'", word),
+		Skip(NotFollowedBy(Seq(Literal(word), cont)), Literal(word)))
+}
+
+// Keywords matches the longest of words at this point; so Keywords("in", "int")
+// matches all of "int". Its value is the matched word.
+// It's equivalent to an Alt of Literals, longest first, but matches in time
+// proportional to the length of the match rather than the number of words.
+func Keywords(words ...string) Parser {
+	p := &pKeywords{words: words, root: &keywordNode{}}
+	for _, w := range words {
+		n := p.root
+		for i := 0; i < len(w); i++ {
+			next, ok := n.next[w[i]]
+			if !ok {
+				if n.next == nil {
+					n.next = make(map[byte]*keywordNode)
+				}
+				next = &keywordNode{}
+				n.next[w[i]] = next
+			}
+			n = next
+		}
+		n.end, n.word = true, w
+	}
+	return p
+}
+
+type pKeywords struct {
+	words []string
+	root  *keywordNode
+}
+
+// keywordNode is a node in the trie of keywords, reached by the bytes of a
+// prefix of one or more of them. end marks a complete keyword, word.
+type keywordNode struct {
+	next map[byte]*keywordNode
+	end  bool
+	word string
+}
+
+func (p *pKeywords) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
+	var match Stream
+	var word string
+	for n := p.root; n != nil; {
+		if n.end {
+			match, word = ps, n.word
+		}
+		c, eof := ps.Head()
+		if eof {
+			break
+		}
+		n = n.next[c]
+		ps = ps.Tail()
+	}
+	if match == nil {
+		expected := make([]string, len(p.words))
+		for i, w := range p.words {
+			expected[i] = fmt.Sprintf("literal '%s'", w)
+		}
+		return nil, start.Loc().mkErrorExpectations(expected)
+	}
+	return match.SetValue(word), nil
+}
+
+func (p *pKeywords) describe() string {
+	quoted := make([]string, len(p.words))
+	for i, w := range p.words {
+		quoted[i] = fmt.Sprintf("%q", w)
+	}
+	return "Keywords(" + strings.Join(quoted, ", ") + ")"
+}
+
+// AnyChar parses any single character, returning it as the value.
+func AnyChar() Parser {
+	return &anyCharSingleton
+}
+
+type pAnyChar struct{}
+
+var anyCharSingleton pAnyChar
+
+func (p *pAnyChar) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	c, eof := ps.Head()
+	if eof {
+		return nil, ps.Loc().mkErrorMessage("unexpected EOF")
+	}
+	return ps.Tail().SetValue(c), nil
+}
+
+func (p *pAnyChar) describe() string {
+	return "AnyChar"
+}
+
+// Take parses exactly n bytes, whatever they are, and its value is them as a
+// []byte. It's the byte-level equivalent of Count(n, AnyChar()), for
+// length-prefixed data. Panics if n is negative.
+func Take(n int) Parser {
+	if n < 0 {
+		panic(fmt.Sprintf("Take with negative n %d", n))
+	}
+	return &pTake{n}
+}
+
+type pTake struct {
+	n int
+}
+
+func (p *pTake) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	out := make([]byte, p.n)
+	for i := range out {
+		c, eof := ps.Head()
+		if eof {
+			return nil, ps.Loc().mkErrorMessage("unexpected EOF")
+		}
+		out[i] = c
+		ps = ps.Tail()
+	}
+	return ps.SetValue(out), nil
+}
+
+func (p *pTake) describe() string {
+	return fmt.Sprintf("Take(%d)", p.n)
+}
+
+// EOF matches only at the end of the input, consuming nothing.
+// Its value is nil.
+func EOF() Parser {
+	return &eofSingleton
+}
+
+type pEOF struct{}
+
+var eofSingleton pEOF
+
+func (p *pEOF) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	if atEnd(ps) {
+		return ps.SetValue(nil), nil
+	}
+	return nil, ps.Loc().mkErrorExpect("end of input")
+}
+
+func (p *pEOF) describe() string {
+	return "EOF"
+}
+
+// EndOfLine matches the end of a line: "\n", "\r\n" or the end of the input.
+// Its value is nil.
+func EndOfLine() Parser {
+	return &endOfLineSingleton
+}
+
+type pEndOfLine struct{}
+
+var endOfLineSingleton pEndOfLine
+
+func (p *pEndOfLine) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	c, eof := ps.Head()
+	switch {
+	case eof:
+		return ps.SetValue(nil), nil
+	case c == '\n':
+		return ps.Tail().SetValue(nil), nil
+	case c == '\r':
+		next := ps.Tail()
+		if c, eof := next.Head(); !eof && c == '\n' {
+			return next.Tail().SetValue(nil), nil
+		}
+	}
+	return nil, ps.Loc().mkErrorExpect("end of line")
+}
+
+func (p *pEndOfLine) describe() string {
+	return "EndOfLine"
+}
+
+// AtLineStart runs p only at the start of a line, column 0, and fails with
+// "expected start of line" anywhere else. It suits line-oriented formats, such
+// as Markdown headings.
+func AtLineStart(p Parser) Parser {
+	return &pAtLineStart{p}
+}
+
+type pAtLineStart struct {
+	inner Parser
+}
+
+func (p *pAtLineStart) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	if ps.Loc().Col != 0 {
+		return nil, ps.Loc().mkErrorExpect("start of line")
+	}
+	return p.inner.Parse(ps, g)
+}
+
+func (p *pAtLineStart) describe() string {
+	return "AtLineStart(" + describe(p.inner) + ")"
+}
+
+// Position consumes nothing, and its value is the current *Loc. In a Seq, it
+// captures where some part of the match began, for an action to use.
+func Position() Parser {
+	return &positionSingleton
+}
+
+type pPosition struct{}
+
+var positionSingleton pPosition
+
+func (p *pPosition) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	return ps.SetValue(ps.Loc()), nil
+}
+
+func (p *pPosition) describe() string {
+	return "Position"
+}
+
+// Peek looks at the next character without consuming it. Its value is that
+// character as a byte, or nil at EOF; Peek never fails.
+func Peek() Parser {
+	return &peekSingleton
+}
+
+type pPeek struct{}
+
+var peekSingleton pPeek
+
+func (p *pPeek) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	c, eof := ps.Head()
+	if eof {
+		return ps.SetValue(nil), nil
+	}
+	return ps.SetValue(c), nil
+}
+
+func (p *pPeek) describe() string {
+	return "Peek"
+}
+
+// OneOf matches any single character from a string of possibilities.
+// Its value is that single character as a byte.
+func OneOf(options string) Parser {
+	return &pOneOf{options}
+}
+
+type pOneOf struct {
+	options string
+}
+
+func (p *pOneOf) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	c, eof := ps.Head()
+	if eof {
+		return nil, ps.Loc().mkErrorMessage("unexpected EOF, expected one of '%s'", p.options)
+	}
+	for i := 0; i < len(p.options); i++ {
+		if c == p.options[i] {
+			return ps.Tail().SetValue(c), nil
+		}
+	}
+	return nil, ps.Loc().mkErrorMessage("expected one of: %s", p.options)
+}
+
+func (p *pOneOf) describe() string {
+	return fmt.Sprintf("OneOf(%q)", p.options)
+}
+
+// NoneOf matches any single character NOT in a "blacklist" string.
+// Its value is the single character as a byte.
+func NoneOf(blacklist string) Parser {
+	return &pNoneOf{blacklist}
+}
+
+type pNoneOf struct {
+	blacklist string
+}
+
+func (p *pNoneOf) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	c, eof := ps.Head()
+	if eof {
+		return nil, ps.Loc().mkErrorMessage("unexpected EOF")
+	}
+	for i := 0; i < len(p.blacklist); i++ {
+		if c == p.blacklist[i] {
+			return nil, ps.Loc().mkErrorMessage("unexpected %c", c)
+		}
+	}
+	return ps.Tail().SetValue(c), nil
+}
+
+func (p *pNoneOf) describe() string {
+	return fmt.Sprintf("NoneOf(%q)", p.blacklist)
+}
+
+// Range takes two characters (bytes) and parses any character in that range
+// (inclusive).
+// For example, given 'a' and 'z', parses any lowercase letter.
+// Value is the parsed character. Fails on EOF.
+func Range(lo, hi byte) Parser {
+	return &pRange{lo, hi}
+}
+
+type pRange struct {
+	lo, hi byte
+}
+
+func (p *pRange) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	c, eof := ps.Head()
+	if !eof && p.lo <= c && c <= p.hi {
+		return ps.Tail().SetValue(c), nil
+	}
+	return nil, ps.Loc().mkErrorExpect("range(%c..%c)", p.lo, p.hi)
+}
+
+func (p *pRange) describe() string {
+	return fmt.Sprintf("%q..%q", string(p.lo), string(p.hi))
+}
+
+// Satisfy parses any single character (byte) for which pred returns true.
+// Its value is that character. Fails on EOF.
+func Satisfy(pred func(byte) bool) Parser {
+	return &pSatisfy{pred}
+}
+
+type pSatisfy struct {
+	pred func(byte) bool
+}
+
+func (p *pSatisfy) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	c, eof := ps.Head()
+	if eof {
+		return nil, ps.Loc().mkErrorMessage("unexpected EOF")
+	}
+	if !p.pred(c) {
+		return nil, ps.Loc().mkErrorMessage("unexpected %c", c)
+	}
+	return ps.Tail().SetValue(c), nil
+}
+
+func (p *pSatisfy) describe() string {
+	return "Satisfy"
+}
+
+// TakeWhile parses the longest run of bytes, possibly empty, for which pred
+// returns true. Its value is the run as a string.
+// It's a faster Stringify(Many(Satisfy(pred))), for identifiers, numbers and
+// the like.
+func TakeWhile(pred func(byte) bool) Parser {
+	return &pTakeWhile{pred: pred, desc: "TakeWhile"}
+}
+
+// TakeWhile1 is a variant of TakeWhile that requires at least one byte.
+func TakeWhile1(pred func(byte) bool) Parser {
+	return &pTakeWhile{pred: pred, min: 1, desc: "TakeWhile1"}
+}
+
+// TakeWhileNoneOf parses the longest run of bytes, possibly empty, none of
+// which are in blacklist. Its value is the run as a string.
+// It's a faster Stringify(Many(NoneOf(blacklist))), or ManyTill over a
+// terminator in blacklist, since it doesn't build a list of values or retry a
+// terminator at every byte.
+func TakeWhileNoneOf(blacklist string) Parser {
+	var banned [256]bool
+	for i := 0; i < len(blacklist); i++ {
+		banned[blacklist[i]] = true
+	}
+	return &pTakeWhile{
+		pred: func(c byte) bool { return !banned[c] },
+		desc: fmt.Sprintf("TakeWhileNoneOf(%q)", blacklist),
+	}
+}
+
+type pTakeWhile struct {
+	pred func(byte) bool
+	min  int
+	desc string
+}
+
+func (p *pTakeWhile) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
+	n := 0
+	for {
+		c, eof := ps.Head()
+		if eof || !p.pred(c) {
+			if n >= p.min {
+				return ps.SetValue(matchedText(start, ps)), nil
+			}
+			if eof {
+				return nil, ps.Loc().mkErrorMessage("unexpected EOF")
+			}
+			return nil, ps.Loc().mkErrorMessage("unexpected %c", c)
+		}
+		ps = ps.Tail()
+		n++
+	}
+}
+
+func (p *pTakeWhile) describe() string {
+	return p.desc
+}
+
+// Many parses 0 or more copies of its inner parser, returning an array of its
+// results.
+func Many(p Parser) Parser {
+	return ManyMin(p, 0)
+}
+
+// Many1 is a variant of Many that parses 1 or more copies.
+func Many1(p Parser) Parser {
+	return ManyMin(p, 1)
+}
+
+// ManyMin is a variant of Many with a user-defined minimum.
+func ManyMin(p Parser, min int) Parser {
+	return &pMany{p, min, -1, true}
+}
+
+// ManyDrop parses 0 or more copies, but discards the results rather than
+// building an array.
+func ManyDrop(p Parser) Parser {
+	return &pMany{p, 0, -1, false}
+}
+
+// Many1Drop is a variant of ManyDrop that requires at least one copy.
+func Many1Drop(p Parser) Parser {
+	return &pMany{p, 1, -1, false}
+}
+
+// ManyRange is a variant of Many which parses at least min and at most max
+// copies. It stops after max even if more copies would match.
+// A negative max means no limit. Panics if max is less than min.
+func ManyRange(p Parser, min, max int) Parser {
+	if max < 0 {
+		max = -1
+	} else if max < min {
+		panic(fmt.Sprintf("ManyRange with min %d and max %d", min, max))
+	}
+	return &pMany{p, min, max, true}
+}
+
+// zeroProgressError reports that a loop's inner parser matched without
+// consuming anything, and so would have matched forever. That's a mistake in
+// the grammar, so the error is committed.
+func zeroProgressError(ps Stream, loop string, inner Parser) *ParseError {
+	err := ps.Loc().mkErrorMessage("%s would loop forever: %s matched without consuming input", loop, describe(inner))
+	err.committed = true
+	return err
+}
+
+// Progress runs its inner parser, but fails if it succeeds without consuming
+// any input. Its value is the inner parser's.
+// It's useful inside loops like Many, whose inner parser must consume
+// something each time.
+func Progress(p Parser) Parser {
+	return &pProgress{p}
+}
+
+type pProgress struct {
+	inner Parser
+}
+
+func (p *pProgress) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	res, err := p.inner.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	if res.Offset() == ps.Offset() {
+		return nil, ps.Loc().mkErrorMessage("expected %s to consume input", describe(p.inner))
+	}
+	return res, nil
+}
+
+func (p *pProgress) describe() string {
+	return "Progress(" + describe(p.inner) + ")"
+}
+
+type pMany struct {
+	inner   Parser
+	min     int
+	max     int // -1 for no limit.
+	capture bool
+}
+
+// Combined parser for the different flavours of Many.
+func (p *pMany) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	var results []interface{}
+	if p.capture {
+		results = make([]interface{}, 0)
+	}
+
+	found := 0
+	var ps2 Stream
+	var err *ParseError
+	for found != p.max {
+		ps2, err = p.inner.Parse(ps, g)
+		if err != nil {
+			if err.committed {
+				return nil, err
+			}
+			break
+		}
+		if p.max == -1 && ps2.Offset() == ps.Offset() {
+			return nil, zeroProgressError(ps, "Many", p.inner)
+		}
+		found++
+		if p.capture {
+			results = append(results, ps2.Value())
+		}
+		ps = ps2
+	}
+
+	// Check that we've got at least min results.
+	if found < p.min {
+		return nil, &ParseError{
+			loc:      ps.Loc(),
+			message:  fmt.Sprintf("minimum %d", p.min),
+			expected: err.expected,
+		}
+	}
+
+	// Good to return.
+	if p.capture {
+		return ps.SetValue(results), nil
+	}
+	return ps.SetValue(nil), nil
+}
+
+func (p *pMany) describe() string {
+	switch {
+	case p.min == 0 && p.max == -1:
+		return describeTerm(p.inner) + "*"
+	case p.min == 1 && p.max == -1:
+		return describeTerm(p.inner) + "+"
+	case p.max == -1:
+		return fmt.Sprintf("%s{%d,}", describeTerm(p.inner), p.min)
+	}
+	return fmt.Sprintf("%s{%d,%d}", describeTerm(p.inner), p.min, p.max)
+}
+
+// Count parses exactly n copies of its inner parser, returning an array of
+// their results. It stops after n even if more copies would match.
+// If fewer than n copies succeed, Count fails with the inner parser's error.
+// Panics if n is negative.
+func Count(n int, p Parser) Parser {
+	if n < 0 {
+		panic(fmt.Sprintf("Count with negative n %d", n))
+	}
+	return &pCount{p, n}
+}
+
+type pCount struct {
+	inner Parser
+	n     int
+}
+
+func (p *pCount) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	results := make([]interface{}, p.n)
+	var err *ParseError
+	for i := 0; i < p.n; i++ {
+		ps, err = p.inner.Parse(ps, g)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = ps.Value()
+	}
+	return ps.SetValue(results), nil
+}
+
+func (p *pCount) describe() string {
+	return fmt.Sprintf("%s{%d}", describeTerm(p.inner), p.n)
+}
+
+// Fold parses 0 or more copies of its inner parser, like Many, but rather than
+// collecting their values it combines each into an accumulator, starting from
+// init. Its value is the final accumulator.
+func Fold(p Parser, init interface{}, step func(acc, v interface{}) interface{}) Parser {
+	return &pFold{p, init, step}
+}
+
+type pFold struct {
+	inner Parser
+	init  interface{}
+	step  func(acc, v interface{}) interface{}
+}
+
+func (p *pFold) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	acc := p.init
+	for {
+		ps2, err := p.inner.Parse(ps, g)
+		if err != nil {
+			if err.committed {
+				return nil, err
+			}
+			return ps.SetValue(acc), nil
+		}
+		if ps2.Offset() == ps.Offset() {
+			return nil, zeroProgressError(ps, "Fold", p.inner)
+		}
+		acc = p.step(acc, ps2.Value())
+		ps = ps2
+	}
+}
+
+func (p *pFold) describe() string {
+	return "Fold(" + describe(p.inner) + ")"
+}
+
+// SepBy matches 0 or more of one parser, separated by a second parser.
+// The value is a list of the first parser's results.
+// Does NOT consume a trailing separator.
+func SepBy(p, sep Parser) Parser {
+	return &pSepBy{p, sep, 0, -1, false}
+}
+
+// SepBy1 matches 1 or more of one parser, separated by a second parser.
+// The value is a list of the first parser's results.
+// Does NOT consume a trailing separator.
+func SepBy1(p, sep Parser) Parser {
+	return &pSepBy{p, sep, 1, -1, false}
+}
+
+// Separated is the value of SepByWithSeps: the items, and the separators
+// between them, each in source order. There is always one fewer separator than
+// items, unless both are empty.
+type Separated struct {
+	Items []interface{}
+	Seps  []interface{}
+}
+
+// SepByWithSeps is a variant of SepBy whose value is a Separated, so that the
+// separators' values are kept as well as the items'.
+func SepByWithSeps(p, sep Parser) Parser {
+	return &pSepBy{p, sep, 0, -1, true}
+}
+
+// SepByN matches between min and max of one parser, separated by a second
+// parser. It stops after max items, leaving any further separator and items
+// unconsumed. A negative max means no limit.
 // The value is a list of the first parser's results.
-// Does NOT consume a trailing separator.
-func SepBy1(p, sep Parser) Parser {
-	return &pSepBy{p, sep, 1}
+// Panics if max is less than min.
+func SepByN(p, sep Parser, min, max int) Parser {
+	if max < 0 {
+		max = -1
+	} else if max < min {
+		panic(fmt.Sprintf("SepByN with min %d and max %d", min, max))
+	}
+	return &pSepBy{p, sep, min, max, false}
+}
+
+// CountSepBy matches exactly n of one parser, separated by a second parser.
+// Unlike Count, it fails if another separator and item follow the n items.
+// The value is a list of the first parser's results.
+func CountSepBy(n int, p, sep Parser) Parser {
+	more := p
+	if n > 0 {
+		more = Seq(sep, p)
+	}
+	return &pCountSepBy{SepByN(p, sep, n, n), more, n}
+}
+
+type pCountSepBy struct {
+	items, more Parser
+	n           int
+}
+
+func (p *pCountSepBy) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	ps, err := p.items.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	if extra, _ := p.more.Parse(ps, g); extra != nil {
+		return nil, ps.Loc().mkErrorMessage("expected exactly %d, but found more", p.n)
+	}
+	return ps, nil
+}
+
+func (p *pCountSepBy) describe() string {
+	return fmt.Sprintf("%s{%d}", describeTerm(p.items), p.n)
 }
 
 type pSepBy struct {
 	inner, sep Parser
 	min        int
+	max        int // -1 for no limit.
+	keepSeps   bool
 }
 
-func (p *pSepBy) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
+func (p *pSepBy) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
 	results := make([]interface{}, 0)
+	seps := make([]interface{}, 0)
 
-	var last Stream
+	// ps is always just past the last item, so a separator is only consumed
+	// once an item has been found after it.
+	next := ps
 	var err error
-	for ps != nil {
-		last = ps
-		ps, err = p.inner.Parse(ps, g)
-		if ps != nil {
-			results = append(results, ps.Value())
-		} else {
+	for len(results) != p.max {
+		before := next
+		item, e := p.inner.Parse(next, g)
+		if item == nil {
+			if e.committed {
+				return nil, e
+			}
+			err = e
 			break
 		}
-		last = ps
-		ps, err = p.sep.Parse(ps, g)
+		if len(results) > 0 {
+			seps = append(seps, next.Value())
+		}
+		results = append(results, item.Value())
+		ps = item
+
+		next, e = p.sep.Parse(ps, g)
+		if next == nil {
+			if e.committed {
+				return nil, e
+			}
+			err = e
+			break
+		}
+		if p.max == -1 && next.Offset() == before.Offset() {
+			return nil, zeroProgressError(next, "SepBy", Seq(p.inner, p.sep))
+		}
 	}
 
 	// TODO: This swallows errors in an unfortunate way.
@@ -505,7 +1836,83 @@ func (p *pSepBy) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
 			"expected at least %d: %v", p.min, err)
 	}
 
-	return last.SetValue(results), nil
+	if p.keepSeps {
+		return ps.SetValue(Separated{results, seps}), nil
+	}
+	return ps.SetValue(results), nil
+}
+
+func (p *pSepBy) describe() string {
+	if p.max != -1 {
+		return fmt.Sprintf("SepByN(%s, %s, %d, %d)", describe(p.inner), describe(p.sep), p.min, p.max)
+	}
+	name := "SepBy"
+	if p.min == 1 {
+		name = "SepBy1"
+	}
+	return fmt.Sprintf("%s(%s, %s)", name, describe(p.inner), describe(p.sep))
+}
+
+// SepEndBy matches 0 or more of one parser, separated by a second parser, with
+// an optional trailing separator.
+// The value is a list of the first parser's results.
+func SepEndBy(p, sep Parser) Parser {
+	return &pSepEndBy{p, sep, 0}
+}
+
+// SepEndBy1 matches 1 or more of one parser, separated by a second parser, with
+// an optional trailing separator.
+// The value is a list of the first parser's results.
+func SepEndBy1(p, sep Parser) Parser {
+	return &pSepEndBy{p, sep, 1}
+}
+
+type pSepEndBy struct {
+	inner, sep Parser
+	min        int
+}
+
+func (p *pSepEndBy) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	results := make([]interface{}, 0)
+
+	var err *ParseError
+	for {
+		last := ps
+		var item Stream
+		item, err = p.inner.Parse(ps, g)
+		if item == nil {
+			break
+		}
+		results = append(results, item.Value())
+		ps = item
+
+		var next Stream
+		next, err = p.sep.Parse(ps, g)
+		if next == nil {
+			break
+		}
+		if next.Offset() == last.Offset() {
+			return nil, zeroProgressError(next, "SepEndBy", Seq(p.inner, p.sep))
+		}
+		ps = next
+	}
+
+	if err.committed {
+		return nil, err
+	}
+	if p.min > len(results) {
+		return nil, ps.Loc().mkErrorMessage(
+			"expected at least %d: %v", p.min, err)
+	}
+	return ps.SetValue(results), nil
+}
+
+func (p *pSepEndBy) describe() string {
+	name := "SepEndBy"
+	if p.min == 1 {
+		name = "SepEndBy1"
+	}
+	return fmt.Sprintf("%s(%s, %s)", name, describe(p.inner), describe(p.sep))
 }
 
 // EndBy matches 0 or more of one parser, each followed by a second parser.
@@ -525,29 +1932,49 @@ type pEndBy struct {
 	min        int
 }
 
-func (p *pEndBy) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
+func (p *pEndBy) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
 	results := make([]interface{}, 0)
 
 	var last Stream
-	var err *parseError
+	var err *ParseError
 	for ps != nil {
 		last = ps
 		ps, err = p.inner.Parse(ps, g)
 		if ps == nil {
 			break
 		}
-		results = append(results, ps.Value())
+		// The item only counts once its separator has matched too.
+		item := ps.Value()
 		ps, err = p.sep.Parse(ps, g)
+		if ps == nil {
+			break
+		}
+		if ps.Offset() == last.Offset() {
+			return nil, zeroProgressError(ps, "EndBy", Seq(p.inner, p.sep))
+		}
+		results = append(results, item)
+	}
+	if err.committed {
+		return nil, err
 	}
 
+	// ps is always nil here, so report the failure where the last attempt began.
 	if p.min > len(results) {
-		return nil, ps.Loc().mkErrorMessage(
+		return nil, last.Loc().mkErrorMessage(
 			"expected at least %d: %v", p.min, err)
 	}
 
 	return last.SetValue(results), nil
 }
 
+func (p *pEndBy) describe() string {
+	name := "EndBy"
+	if p.min == 1 {
+		name = "EndBy1"
+	}
+	return fmt.Sprintf("%s(%s, %s)", name, describe(p.inner), describe(p.sep))
+}
+
 // ManyTill finds 0 or more instances of one parser, until it finds a
 // terminator.
 // This is "non-greedy", in the regular expression sense. It tries to parse the
@@ -563,66 +1990,427 @@ func (p *pEndBy) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
 // string: SeqAt(1, Literal("\""), ManyTill(AnyChar(), Literal("\"")))
 // lineComment: Seq(Literal("//"), ManyTill(AnyChar(), Literal("\n")))
 func ManyTill(inner, terminator Parser) Parser {
-	return &pManyTill{inner, terminator}
+	return &pManyTill{inner, terminator, false}
+}
+
+// ManyTillResult is the value of ManyTillT: the inner parser's values, and that
+// of the terminator which ended the loop.
+type ManyTillResult struct {
+	Items      []interface{}
+	Terminator interface{}
+}
+
+// ManyTillT is a variant of ManyTill whose value is a ManyTillResult, so the
+// caller can see what the terminator matched as well.
+func ManyTillT(inner, terminator Parser) Parser {
+	return &pManyTill{inner, terminator, true}
 }
 
 type pManyTill struct {
 	inner, terminator Parser
+	keepTerminator    bool
 }
 
-func (p *pManyTill) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
+func (p *pManyTill) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
 	results := make([]interface{}, 0)
 	for {
 		tps, err := p.terminator.Parse(ps, g)
 		if tps != nil {
+			if p.keepTerminator {
+				return tps.SetValue(ManyTillResult{results, tps.Value()}), nil
+			}
 			return tps.SetValue(results), nil
 		}
-		ps, err = p.inner.Parse(ps, g)
+		if err.committed {
+			return nil, err
+		}
+		ips, err := p.inner.Parse(ps, g)
 		if err != nil {
-			return nil, ps.Loc().mkErrorMessage(
+			wrapped := ps.Loc().mkErrorMessage(
 				"failed to parse many %v", err)
+			wrapped.committed = err.committed
+			return nil, wrapped
 		}
+		if ips.Offset() == ps.Offset() {
+			return nil, zeroProgressError(ps, "ManyTill", p.inner)
+		}
+		ps = ips
 		results = append(results, ps.Value())
 	}
 }
 
-func parserWithAction(p Parser, act Action) Parser {
-	return &pWithAction{p, act}
+func (p *pManyTill) describe() string {
+	return fmt.Sprintf("ManyTill(%s, %s)", describe(p.inner), describe(p.terminator))
+}
+
+// Map wraps another parser, passing its value through an Action. The Action's
+// result becomes the new value. If the Action returns an error, Map fails with
+// that error at the current location.
+// This is the same mechanism as Grammar.WithAction, but needs no named symbol.
+func Map(p Parser, act Action) Parser {
+	return &pWithAction{p, act, false}
+}
+
+// MapLoc is a variant of Map which passes the Action the location where p
+// started, rather than where it finished. That makes it the one to use for
+// building AST nodes which record their source position.
+// Errors from the Action are reported at that starting location too.
+func MapLoc(p Parser, act Action) Parser {
+	return &pWithAction{p, act, true}
 }
 
 type pWithAction struct {
-	inner  Parser
-	action Action
+	inner    Parser
+	action   Action
+	startLoc bool
 }
 
-func (p *pWithAction) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
+func (p *pWithAction) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
 	ps, err := p.inner.Parse(ps, g)
 	if err != nil {
 		return nil, err
 	}
-	res, e := p.action(ps.Value(), ps.Loc())
+	loc := ps.Loc()
+	if p.startLoc {
+		loc = start.Loc()
+	}
+	res, e := p.action(ps.Value(), loc)
 	if e != nil {
-		return nil, ps.Loc().mkErrorMessage(e.Error())
+		return nil, loc.mkErrorMessage("%s", e.Error())
 	}
 	return ps.SetValue(res), nil
 }
 
+func (p *pWithAction) describe() string {
+	return describe(p.inner)
+}
+
+// Verify runs its inner parser, and then checks its value with pred. If pred
+// returns false, Verify fails with msg, at the location where the inner parser
+// started. Otherwise its value is the inner parser's value.
+func Verify(p Parser, pred func(v interface{}) bool, msg string) Parser {
+	return &pVerify{p, pred, msg}
+}
+
+type pVerify struct {
+	inner Parser
+	pred  func(v interface{}) bool
+	msg   string
+}
+
+func (p *pVerify) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	res, err := p.inner.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	if !p.pred(res.Value()) {
+		return nil, ps.Loc().mkErrorMessage("%s", p.msg)
+	}
+	return res, nil
+}
+
+func (p *pVerify) describe() string {
+	return "Verify(" + describe(p.inner) + ")"
+}
+
+// Memoize caches the results of its inner parser, so that when the parse
+// backtracks and tries it again at the same position, the first result is
+// reused rather than parsed all over again. key names the cache; give each
+// Memoize its own key, since those with the same key share results.
+// The cache only lasts for a single parse. It is keyed on the position alone,
+// so don't memoize parsers whose result depends on the user state.
+func Memoize(key string, p Parser) Parser {
+	return &pMemoize{p, key}
+}
+
+type pMemoize struct {
+	inner Parser
+	key   string
+}
+
+type memoKey struct {
+	key    string
+	offset int
+}
+
+type memoResult struct {
+	ps  Stream
+	err *ParseError
+}
+
+func (p *pMemoize) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	k := memoKey{p.key, ps.Offset()}
+	if r, ok := g.memo[k]; ok {
+		return r.ps, r.err
+	}
+	res, err := p.inner.Parse(ps, g)
+	if g.memo == nil {
+		g.memo = make(map[memoKey]memoResult)
+	}
+	g.memo[k] = memoResult{res, err}
+	return res, err
+}
+
+func (p *pMemoize) describe() string {
+	return describe(p.inner)
+}
+
+// Cut commits to its inner parser: if it fails, enclosing Alts, Optionals and
+// repetitions won't backtrack and try something else, but fail immediately with
+// the inner parser's error.
+// Place it just after the point where the input is known to be unambiguous,
+// eg. Seq(Literal("\""), Cut(restOfKeyValue)).
+func Cut(p Parser) Parser {
+	return &pCut{p}
+}
+
+type pCut struct {
+	inner Parser
+}
+
+func (p *pCut) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	res, err := p.inner.Parse(ps, g)
+	if err != nil && !err.committed {
+		dup := *err
+		dup.committed = true
+		return nil, &dup
+	}
+	return res, err
+}
+
+func (p *pCut) describe() string {
+	return "Cut(" + describe(p.inner) + ")"
+}
+
+// Label names what its inner parser expects, for nicer error messages: when the
+// inner parser fails without consuming any input, Label replaces the error with
+// "expected <name>". If the inner parser got further before failing, its error
+// is more specific and is left intact.
+func Label(name string, p Parser) Parser {
+	return &pLabel{p, name}
+}
+
+type pLabel struct {
+	inner Parser
+	name  string
+}
+
+func (p *pLabel) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	res, err := p.inner.Parse(ps, g)
+	if err == nil || err.committed {
+		return res, err
+	}
+	start := ps.Loc()
+	if err.loc.Compare(start) == 0 {
+		return nil, start.mkErrorExpect("%s", p.name)
+	}
+	return nil, err
+}
+
+func (p *pLabel) describe() string {
+	return "<" + p.name + ">"
+}
+
+// Expect is a stronger Label: whenever its inner parser fails, even after
+// consuming some input, the error's expectation becomes "expected <name>".
+// Unlike Label, the error keeps the inner parser's location and any message,
+// so it still points at where the parse actually went wrong.
+func Expect(name string, p Parser) Parser {
+	return &pExpect{p, name}
+}
+
+type pExpect struct {
+	inner Parser
+	name  string
+}
+
+func (p *pExpect) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	res, err := p.inner.Parse(ps, g)
+	if err == nil {
+		return res, nil
+	}
+	forced := *err
+	forced.expected = []string{p.name}
+	return nil, &forced
+}
+
+func (p *pExpect) describe() string {
+	return "<" + p.name + ">"
+}
+
+// ParserFunc adapts a plain function into a Parser, for custom logic working
+// directly on the Stream. On success, f should return the Stream following
+// whatever it consumed, with its value set. On failure, it should return an
+// error, ideally built with Errorf or Expected on the Stream's Loc; any other
+// error is reported at the position where f started.
+func ParserFunc(f func(s Stream) (Stream, error)) Parser {
+	return &pFunc{f}
+}
+
+type pFunc struct {
+	f func(s Stream) (Stream, error)
+}
+
+func (p *pFunc) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	res, err := p.f(ps)
+	if err != nil {
+		if pe, ok := err.(*ParseError); ok {
+			return nil, pe
+		}
+		return nil, ps.Loc().mkErrorMessage("%s", err.Error())
+	}
+	return res, nil
+}
+
+func (p *pFunc) describe() string {
+	return "ParserFunc"
+}
+
+// Errorf builds a parse error at this location, with a message formatted as
+// with fmt.Sprintf. It's intended for use with ParserFunc.
+func (l *Loc) Errorf(format string, args ...interface{}) error {
+	return l.mkErrorMessage(format, args...)
+}
+
+// Expected builds a parse error at this location saying what was expected
+// there, eg. "digit". Unlike Errorf, Alt combines these with the expectations
+// of its other branches. It's intended for use with ParserFunc.
+func (l *Loc) Expected(what string) error {
+	return l.mkErrorExpect("%s", what)
+}
+
 // Symbol runs another parser in the grammar by name.
+// The name is looked up each time, unless the grammar is compiled; see
+// Grammar.Compile.
 func Symbol(name string) Parser {
-	return &pSymbol{name}
+	return &pSymbol{name: name}
 }
 
 type pSymbol struct {
 	name string
+
+	// A *symbolResolution, remembering the parser this symbol named in the
+	// most recently compiled grammar that used it.
+	resolved atomic.Value
+}
+
+type symbolResolution struct {
+	owner  *compiledGrammar
+	parser Parser
+}
+
+func (p *pSymbol) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	if err := g.checkContext(ps); err != nil {
+		return nil, err
+	}
+
+	var inner Parser
+	if r, _ := p.resolved.Load().(*symbolResolution); r != nil && r.owner == g.compiled && r.owner != nil {
+		inner = r.parser
+	} else if found, ok := g.symbols[p.name]; ok {
+		inner = found
+		if g.compiled != nil {
+			p.resolved.Store(&symbolResolution{g.compiled, inner})
+		}
+	} else {
+		// This is a programming error, not a problem with the user input, so a
+		// panic is an appropriate reaction.
+		panic(fmt.Sprintf("no symbol named '%s'", p.name))
+	}
+
+	if g.depth++; g.maxDepth > 0 && g.depth > g.maxDepth {
+		g.depth--
+		return nil, &ParseError{loc: ps.Loc(), message: "maximum nesting depth exceeded", committed: true}
+	}
+	var res Stream
+	var err *ParseError
+	if g.cache != nil && g.cached[p.name] {
+		res, err = g.cache.parseCached(p.name, inner, ps, g)
+	} else {
+		res, err = inner.Parse(ps, g)
+	}
+	g.depth--
+	return res, err
+}
+
+func (p *pSymbol) describe() string {
+	return p.name
+}
+
+// Lazy defers building a parser until it's first used, by calling thunk. The
+// result is kept, so thunk is only called once.
+// This allows recursive parsers built as plain Go values, without going through
+// a Grammar's symbols:
+//
+//	var expr Parser
+//	expr = Alt(Literal("x"), Between(Literal("("), Lazy(func() Parser { return expr }), Literal(")")))
+func Lazy(thunk func() Parser) Parser {
+	return &pLazy{thunk: thunk}
+}
+
+type pLazy struct {
+	once  sync.Once
+	thunk func() Parser
+	inner Parser
 }
 
-func (p *pSymbol) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
-	if inner, ok := g[p.name]; ok {
-		return inner.Parse(ps, g)
+func (p *pLazy) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	p.once.Do(func() { p.inner = p.thunk() })
+	return p.inner.Parse(ps, g)
+}
+
+func (p *pLazy) describe() string {
+	return "Lazy"
+}
+
+// RuleSet declares parsers by name ahead of defining them, for mutually
+// recursive parsers built as plain Go values, like a Grammar's symbols but
+// without needing one to parse:
+//
+//	rules := NewRuleSet()
+//	expr := rules.Define("expr")
+//	rules.Set("expr", Alt(Literal("x"), Between(Literal("("), expr, Literal(")"))))
+type RuleSet struct {
+	rules map[string]*pRule
+}
+
+// NewRuleSet returns an empty RuleSet.
+func NewRuleSet() *RuleSet {
+	return &RuleSet{rules: make(map[string]*pRule)}
+}
+
+// Define returns a parser standing for the rule name, which runs whatever
+// parser Set gives it. It can be used before the rule is Set, but panics if it
+// is ever run without one.
+func (rs *RuleSet) Define(name string) Parser {
+	r, ok := rs.rules[name]
+	if !ok {
+		r = &pRule{name: name}
+		rs.rules[name] = r
+	}
+	return r
+}
+
+// Set gives the rule name its parser, replacing any previous one.
+func (rs *RuleSet) Set(name string, p Parser) {
+	rs.Define(name).(*pRule).inner = p
+}
+
+type pRule struct {
+	name  string
+	inner Parser
+}
+
+func (p *pRule) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	if p.inner == nil {
+		panic(fmt.Sprintf("rule '%s' was never Set", p.name))
 	}
-	// This is a programming error, not a problem with the user input, so a panic
-	// is an appropriate reaction.
-	panic(fmt.Sprintf("no symbol named '%s'", p.name))
+	return p.inner.Parse(ps, g)
+}
+
+func (p *pRule) describe() string {
+	return p.name
 }
 
 // Grammar represents a complete parsing system: a set of symbols, a start
@@ -631,17 +2419,110 @@ func (p *pSymbol) Parse(ps Stream, g symbolTable) (Stream, *parseError) {
 type Grammar struct {
 	symbols     symbolTable
 	startSymbol string
+	trace       io.Writer
+	whitespace  Parser
+	cache       *Cache
+	cached      map[string]bool
+	compiled    *compiledGrammar
+	maxDepth    int
 }
 
 // NewGrammar builds an empty grammar, with the conventional start symbol
 // 'START'.
 func NewGrammar() *Grammar {
-	return &Grammar{make(map[string]Parser), "START"}
+	return &Grammar{
+		symbols:     make(map[string]Parser),
+		startSymbol: "START",
+		trace:       os.Stderr,
+		whitespace:  ManyDrop(OneOf(" \t\r\n")),
+	}
+}
+
+// SetMaxDepth limits how deeply symbols may be nested during a parse, such as
+// the rules for nested arrays, to n. Past that, the parse fails with "maximum
+// nesting depth exceeded", rather than recursing without limit and eventually
+// overflowing the stack on deeply nested input. The failure is committed, as
+// with Cut, so nothing backtracks around it. A limit of 0, the default, means
+// no limit.
+func (g *Grammar) SetMaxDepth(n int) {
+	g.maxDepth = n
+}
+
+// SetTraceOutput sets where Trace parsers write their logs. The default is
+// os.Stderr. A nil w turns tracing off.
+func (g *Grammar) SetTraceOutput(w io.Writer) {
+	g.trace = w
+}
+
+// Clone returns a copy of the grammar, which can be extended or have its
+// symbols overridden without affecting the original.
+// The parsers themselves are immutable, so they are shared.
+func (g *Grammar) Clone() *Grammar {
+	dup := *g
+	dup.compiled = nil
+	dup.symbols = make(symbolTable, len(g.symbols))
+	for k, v := range g.symbols {
+		dup.symbols[k] = v
+	}
+	return &dup
+}
+
+// Symbols returns the names of all the grammar's symbols, sorted.
+func (g *Grammar) Symbols() []string {
+	names := make([]string, 0, len(g.symbols))
+	for k := range g.symbols {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StartSymbol returns the name of the grammar's start symbol.
+func (g *Grammar) StartSymbol() string {
+	return g.startSymbol
+}
+
+// SetStartSymbol changes the symbol ParseString and friends start from.
+// Panics if the symbol does not exist.
+func (g *Grammar) SetStartSymbol(name string) {
+	if _, ok := g.symbols[name]; !ok {
+		panic(fmt.Sprintf("no such symbol: '%s'", name))
+	}
+	g.startSymbol = name
+}
+
+// compiledGrammar marks a compiled grammar: Symbols resolved while parsing with
+// it are remembered until the grammar changes.
+type compiledGrammar struct {
+	symbols symbolTable // Also keeps each compiledGrammar a distinct allocation.
+}
+
+// Compile speeds up parsing with the grammar as it stands, by having each
+// Symbol remember the parser it refers to, rather than looking up its name every
+// time. Call it once all the symbols are added. Symbols still refer to each other
+// by name until they are first used, so recursive rules work as usual.
+// Changing the grammar afterwards, eg. with AddSymbol, undoes Compile, so call
+// it again once the changes are made.
+// Grammars sharing parsers, such as clones, can each be compiled, but the
+// Symbols only remember one grammar at a time, so they are fastest when only
+// one is in use.
+func (g *Grammar) Compile() {
+	g.compiled = &compiledGrammar{g.symbols}
 }
 
 // AddSymbol adds or overwrites a symbol in the grammar.
 func (g *Grammar) AddSymbol(name string, p Parser) {
 	g.symbols[name] = p
+	g.compiled = nil
+}
+
+// AddRule is a variant of AddSymbol which returns Symbol(name), so the rule
+// can be used in others without naming it again:
+//
+//	expr := g.AddRule("expr", ...)
+func (g *Grammar) AddRule(name string, p Parser) Parser {
+	g.AddSymbol(name, p)
+	return Symbol(name)
 }
 
 // AddSymbols adds each symbol in a map to the grammar.
@@ -652,9 +2533,11 @@ func (g *Grammar) AddSymbols(syms map[string]Parser) {
 }
 
 // AddAction adds an action to a symbol's parser, wrapping any existing Action.
+// Panics if the symbol does not exist.
 func (g *Grammar) AddAction(name string, action Action) {
 	if p, ok := g.symbols[name]; ok {
-		g.symbols[name] = parserWithAction(p, action)
+		g.AddSymbol(name, Map(p, action))
+		return
 	}
 	panic(fmt.Sprintf("no such symbol: '%s'", name))
 }
@@ -662,19 +2545,37 @@ func (g *Grammar) AddAction(name string, action Action) {
 // WithAction adds a new symbol and an action for it at the same time, replacing
 // any previous parser with that name.
 func (g *Grammar) WithAction(name string, p Parser, action Action) {
-	g.symbols[name] = parserWithAction(p, action)
+	g.AddSymbol(name, Map(p, action))
+}
+
+// WithActionLoc is a variant of WithAction which passes the action the starting
+// location of the match, as with MapLoc.
+func (g *Grammar) WithActionLoc(name string, p Parser, action Action) {
+	g.AddSymbol(name, MapLoc(p, action))
 }
 
 // ParseString is the main entry point.
-// It parses the input string. Returns the parse value on success, and nil on
+// It parses the input string, from the start symbol (see SetStartSymbol).
+// Returns the parse value on success, and nil on
 // failure. (That means a Value of nil can't be distinguished from failure, but
 // that's not a problem in practice.)
+// Errors from a failed parse are always *ParseError.
 func (g *Grammar) ParseString(filename, str string) (interface{}, error) {
-	return g.ParseStringWith(filename, str, "START")
+	return g.ParseStringWith(filename, str, g.startSymbol)
+}
+
+// MustParseString is like ParseString, but panics if the parse fails. It
+// simplifies tests, and parsing known-good inputs.
+func (g *Grammar) MustParseString(filename, str string) interface{} {
+	v, err := g.ParseString(filename, str)
+	if err != nil {
+		panic(fmt.Sprintf("psec: MustParseString: %v", err))
+	}
+	return v
 }
 
 func (g *Grammar) ParseStringWith(filename, str, startSym string) (interface{}, error) {
-	var ps Stream = &stringPS{
+	return g.parse(&stringPS{
 		str:      str,
 		pos:      0,
 		filename: filename,
@@ -682,20 +2583,58 @@ func (g *Grammar) ParseStringWith(filename, str, startSym string) (interface{},
 		col:      0,
 		value:    nil,
 		tail:     nil,
+		arena:    new(streamArena),
+	}, startSym, g.newContext())
+}
+
+func (g *Grammar) newContext() *parseContext {
+	return &parseContext{
+		symbols:    g.symbols,
+		whitespace: g.whitespace,
+		trace:      g.trace,
+		cache:      g.cache,
+		cached:     g.cached,
+		compiled:   g.compiled,
+		maxDepth:   g.maxDepth,
 	}
+}
 
-	if p, ok := g.symbols[startSym]; ok {
-		ps, err := p.Parse(ps, g.symbols)
-		if err != nil {
-			return nil, err
-		}
+// parse runs the start symbol over a fresh stream, requiring it to consume the
+// entire input.
+func (g *Grammar) parse(ps Stream, startSym string, ctx *parseContext) (interface{}, error) {
+	ps, err := g.run(ps, startSym, ctx)
+	if err != nil {
+		return nil, err
+	}
 
-		_, eof := ps.Head()
-		if !eof {
-			return nil, ps.Loc().mkErrorMessage("incomplete parse, expected EOF but input remains: %s", ps.RemainingInput())
-		}
+	if !atEnd(ps) {
+		return nil, ps.Loc().mkErrorMessage("incomplete parse, expected EOF but input remains: %s", ps.RemainingInput())
+	}
+
+	return ps.Value(), nil
+}
 
-		return ps.Value(), nil
+// run runs the start symbol over a fresh stream, returning the stream where it
+// finished.
+func (g *Grammar) run(ps Stream, startSym string, ctx *parseContext) (Stream, *ParseError) {
+	if p, ok := g.symbols[startSym]; ok {
+		return p.Parse(ps, ctx)
 	}
 	panic(fmt.Sprintf("start symbol '%s' does not exist", startSym))
 }
+
+// ParsePrefix parses as much of the input string as startSym matches, without
+// requiring it to reach the end. It returns the parse value and the remaining,
+// unconsumed input.
+func (g *Grammar) ParsePrefix(filename, str, startSym string) (value interface{}, rest string, err error) {
+	ps, perr := g.run(&stringPS{
+		str:      str,
+		filename: filename,
+		line:     1,
+		arena:    new(streamArena),
+	}, startSym, g.newContext())
+	if perr != nil {
+		return nil, str, perr
+	}
+	return ps.Value(), ps.RemainingInput(), nil
+}
@@ -2,6 +2,8 @@ package psec
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -69,6 +71,17 @@ func TestLiteralMismatch(t *testing.T) {
 	}
 }
 
+func TestLiteralValue(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Alt(LiteralValue("true", true), LiteralValue("false", false)))
+	expectValue(t, g, "true", true)
+	expectValue(t, g, "false", false)
+
+	g.AddSymbol("START", LiteralValue("abcd", 7))
+	expectValue(t, g, "abcd", 7)
+	expectError(t, g, "abd", "expected literal 'abcd'")
+}
+
 func TestLiteralCase(t *testing.T) {
 	g := NewGrammar()
 	g.AddSymbol("START", Literal("abc"))
@@ -152,12 +165,19 @@ func expectStrings(t *testing.T, g *Grammar, input string, expected []string) {
 }
 
 func expectError(t *testing.T, g *Grammar, input, expected string) {
+	expectErrorAt(t, g, input, 0, expected)
+}
+
+// expectErrorAt is a variant of expectError for errors on line 1 at other
+// columns.
+func expectErrorAt(t *testing.T, g *Grammar, input string, col int, expected string) {
 	_, err := g.ParseString("test", input)
 	if err == nil {
 		t.Errorf("expected failure, but parsing succeeded")
+		return
 	}
 
-	s := fmt.Sprintf("test line 1 col 0: %s", expected)
+	s := fmt.Sprintf("test line 1 col %d: %s", col, expected)
 	if err.Error() != s {
 		t.Errorf("mismatched error message: %v", err)
 		fmt.Printf("expected: %s\n", s)
@@ -182,7 +202,7 @@ func TestSeq(t *testing.T) {
 
 	expectStrings(t, g, "[a]", []string{"[", "a", "]"})
 	expectStrings(t, g, "[b]", []string{"[", "b", "]"})
-	expectError(t, g, "[c]", "expected one of literal 'a', literal 'b'")
+	expectErrorAt(t, g, "[c]", 1, "expected one of literal 'a', literal 'b'")
 }
 
 func TestSeqAt(t *testing.T) {
@@ -191,8 +211,26 @@ func TestSeqAt(t *testing.T) {
 		SeqAt(1, Literal("["), Alt(Literal("a"), Literal("b")), Literal("]")))
 	expectString(t, g, "[a]", "a")
 	expectString(t, g, "[b]", "b")
-	expectError(t, g, "[c]", "expected one of literal 'a', literal 'b'")
-	expectError(t, g, "[ab", "expected literal ']'")
+	expectErrorAt(t, g, "[c]", 1, "expected one of literal 'a', literal 'b'")
+	expectErrorAt(t, g, "[ab", 2, "expected literal ']'")
+}
+
+func TestSeqMap(t *testing.T) {
+	type pair struct {
+		key   string
+		value int
+	}
+	g := NewGrammar()
+	g.AddSymbol("START", SeqMap(func(vs ...interface{}) (interface{}, error) {
+		if vs[0] == "" {
+			return nil, fmt.Errorf("empty key")
+		}
+		return pair{vs[0].(string), vs[2].(int)}, nil
+	}, TakeWhile(isAlnum), Literal("="), Integer()))
+	expectValue(t, g, "x=12", pair{"x", 12})
+	expectValue(t, g, "key1=-3", pair{"key1", -3})
+	expectErrorAt(t, g, "=3", 2, "empty key")
+	expectErrorAt(t, g, "x:3", 1, "expected literal '='")
 }
 
 func TestOptional(t *testing.T) {
@@ -238,6 +276,74 @@ func TestNoneOf(t *testing.T) {
 	expectError(t, g, "c", "unexpected c")
 }
 
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func TestTakeWhile(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Seq(TakeWhile1(isAlnum), Stringify(Many(AnyChar()))))
+	expectStrings(t, g, "abc123", []string{"abc123", ""})
+	expectStrings(t, g, "x1 = 2", []string{"x1", " = 2"})
+	expectError(t, g, " = 2", "unexpected  ")
+	expectError(t, g, "", "unexpected EOF")
+
+	g.AddSymbol("START", Seq(TakeWhile(isAlnum), Stringify(Many(AnyChar()))))
+	expectStrings(t, g, "x1 = 2", []string{"x1", " = 2"})
+	expectStrings(t, g, " = 2", []string{"", " = 2"})
+	expectStrings(t, g, "", []string{"", ""})
+}
+
+func benchmarkIdentifiers(b *testing.B, ident Parser) {
+	g := NewGrammar()
+	g.AddSymbol("START", Many(Seq(ident, Literal(" "))))
+	input := strings.Repeat("someIdentifier x1 anotherOne ", 300)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := g.ParseString("bench", input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkIdentifiersMany(b *testing.B) {
+	benchmarkIdentifiers(b, Stringify(Many1(Satisfy(isAlnum))))
+}
+
+func BenchmarkIdentifiersTakeWhile(b *testing.B) {
+	benchmarkIdentifiers(b, TakeWhile1(isAlnum))
+}
+
+func TestTakeWhileNoneOf(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Seq(TakeWhileNoneOf("\"\\"), Stringify(Many(AnyChar()))))
+	expectStrings(t, g, `abc"def`, []string{"abc", `"def`})
+	expectStrings(t, g, `ab\c`, []string{"ab", `\c`})
+	expectStrings(t, g, `"`, []string{"", `"`})
+	expectStrings(t, g, "héllo", []string{"héllo", ""})
+	expectStrings(t, g, "", []string{"", ""})
+}
+
+func benchmarkStringBody(b *testing.B, body Parser) {
+	g := NewGrammar()
+	g.AddSymbol("START", SeqAt(1, Literal("\""), body, Literal("\"")))
+	input := "\"" + strings.Repeat("lorem ipsum ", 1000) + "\""
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := g.ParseString("bench", input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStringBodyManyTill(b *testing.B) {
+	benchmarkStringBody(b, Stringify(ManyTill(AnyChar(), LookAhead(Literal("\"")))))
+}
+
+func BenchmarkStringBodyTakeWhileNoneOf(b *testing.B) {
+	benchmarkStringBody(b, TakeWhileNoneOf("\""))
+}
+
 func TestRange(t *testing.T) {
 	g := NewGrammar()
 	g.AddSymbol("START", Range('a', 'z'))
@@ -254,7 +360,7 @@ func TestMany(t *testing.T) {
 	expectString(t, g, "kds", "kds")
 	expectString(t, g, "c", "c")
 	expectString(t, g, "", "")
-	expectError(t, g, "dsCC", "incomplete parse, expected EOF but input remains")
+	expectErrorAt(t, g, "dsCC", 2, "incomplete parse, expected EOF but input remains: CC")
 }
 
 func TestManyMore(t *testing.T) {
@@ -263,7 +369,69 @@ func TestManyMore(t *testing.T) {
 		SeqAt(1, Literal("["), Stringify(Many(Range('a', 'z'))), Literal("]")))
 	expectString(t, g, "[abc]", "abc")
 	expectString(t, g, "[]", "")
-	expectError(t, g, "[A]", "expected literal ']'")
+	expectErrorAt(t, g, "[A]", 1, "expected literal ']'")
+}
+
+func TestManyZeroProgress(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Seq(Many(Optional(Literal("x"))), Literal("y")))
+	expectError(t, g, "y", `Many would loop forever: "x"? matched without consuming input`)
+	expectErrorAt(t, g, "xxy", 2, `Many would loop forever: "x"? matched without consuming input`)
+
+	// A bounded loop stops anyway.
+	g.AddSymbol("START", SeqAt(0, ManyRange(Optional(Literal("x")), 0, 3), Literal("y")))
+	r, err := g.ParseString("test", "xy")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if s := fmt.Sprint(r); s != "[x <nil> <nil>]" {
+		t.Errorf("wrong result: %s", s)
+	}
+}
+
+func TestSepByZeroProgress(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Seq(SepBy(Optional(Literal("x")), Optional(Literal(","))), Literal("y")))
+	expectErrorAt(t, g, "x,xy", 3, `SepBy would loop forever: "x"? ","? matched without consuming input`)
+
+	// Progress by either the items or the separators is enough.
+	g.AddSymbol("START", SeqAt(0, SepBy(Optional(Literal("x")), Literal(",")), Literal("y")))
+	r, err := g.ParseString("test", "x,,xy")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if s := fmt.Sprint(r); s != "[x <nil> x]" {
+		t.Errorf("wrong result: %s", s)
+	}
+}
+
+func TestEndByZeroProgress(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Seq(EndBy(Optional(Literal("x")), Optional(Literal(";"))), Literal("y")))
+	expectErrorAt(t, g, "x;y", 2, `EndBy would loop forever: "x"? ";"? matched without consuming input`)
+
+	g.AddSymbol("START", Seq(SepEndBy(Optional(Literal("x")), Optional(Literal(";"))), Literal("y")))
+	expectErrorAt(t, g, "x;y", 2, `SepEndBy would loop forever: "x"? ";"? matched without consuming input`)
+}
+
+func TestFoldZeroProgress(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Fold(Optional(Literal("x")), 0, func(acc, v interface{}) interface{} {
+		return acc.(int) + 1
+	}))
+	expectError(t, g, "y", `Fold would loop forever: "x"? matched without consuming input`)
+	expectErrorAt(t, g, "xxy", 2, `Fold would loop forever: "x"? matched without consuming input`)
+}
+
+func TestProgress(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", SeqAt(0, Many(Progress(Optional(Literal("x")))), Literal("y")))
+	expectStrings(t, g, "xxy", []string{"x", "x"})
+	expectStrings(t, g, "y", []string{})
+
+	g.AddSymbol("START", Progress(Optional(Literal("x"))))
+	expectString(t, g, "x", "x")
+	expectError(t, g, "", `expected "x"? to consume input`)
 }
 
 func TestMany1(t *testing.T) {
@@ -272,8 +440,8 @@ func TestMany1(t *testing.T) {
 		SeqAt(1, Literal("["), Stringify(Many1(Range('a', 'z'))), Literal("]")))
 	expectString(t, g, "[abc]", "abc")
 	expectString(t, g, "[x]", "x")
-	expectError(t, g, "[]", "minimum 1, expected range(a..z)")
-	expectError(t, g, "[ccA]", "expected literal ']'")
+	expectErrorAt(t, g, "[]", 1, "minimum 1, expected range(a..z)")
+	expectErrorAt(t, g, "[ccA]", 3, "expected literal ']'")
 }
 
 func TestSepBy(t *testing.T) {
@@ -284,6 +452,1073 @@ func TestSepBy(t *testing.T) {
 	expectStrings(t, g, "[abc],[],[z]", []string{"abc", "", "z"})
 	expectStrings(t, g, "[dd]", []string{"dd"})
 	expectStrings(t, g, "", []string{})
-	expectError(t, g, "[aaA],[dc]", "incomplete parse, expected EOF but input remains")
-	expectError(t, g, "[aa]![dc]", "incomplete parse, expected EOF but input remains")
+	expectError(t, g, "[aaA],[dc]", "incomplete parse, expected EOF but input remains: [aaA],[dc]")
+	expectErrorAt(t, g, "[aa]![dc]", 4, "incomplete parse, expected EOF but input remains: ![dc]")
+}
+
+func TestCount(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Stringify(Count(4, Range('0', '9'))))
+	expectString(t, g, "1234", "1234")
+	expectErrorAt(t, g, "12", 2, "expected range(0..9)")
+
+	// Count must leave any further matches for the following parser.
+	g.AddSymbol("START", Seq(Stringify(Count(4, Range('0', '9'))),
+		Stringify(Many(Range('0', '9')))))
+	expectStrings(t, g, "123456", []string{"1234", "56"})
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a negative n to panic")
+		}
+	}()
+	Count(-1, Digit())
+}
+
+func TestTake(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Seq(Take(4), Stringify(Many(AnyChar()))))
+	r, err := g.ParseString("test", "abcdef")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	res := r.([]interface{})
+	if b, ok := res[0].([]byte); !ok || string(b) != "abcd" {
+		t.Errorf("expected []byte abcd, got %#v", res[0])
+	}
+	if res[1] != "ef" {
+		t.Errorf("expected ef to remain, got %v", res[1])
+	}
+
+	g.AddSymbol("START", Take(4))
+	expectErrorAt(t, g, "abc", 3, "unexpected EOF")
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a negative n to panic")
+		}
+	}()
+	Take(-1)
+}
+
+func TestEOF(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", SeqAt(1, Literal("abc"), EOF()))
+	expectNil(t, g, "abc")
+
+	g.AddSymbol("START", EOF())
+	expectNil(t, g, "")
+	expectError(t, g, "abc", "expected end of input")
+
+	g.AddSymbol("START",
+		SeqAt(0, Literal("a"), Alt(Literal(";"), EOF())))
+	expectString(t, g, "a;", "a")
+	expectString(t, g, "a", "a")
+}
+
+func TestMaybe(t *testing.T) {
+	g := NewGrammar()
+	null := Map(Literal("null"), func(interface{}, *Loc) (interface{}, error) { return nil, nil })
+	g.AddSymbol("START", SeqAt(0, Maybe(null), Literal(";")))
+	expectValue(t, g, "null;", MaybeValue{true, nil})
+	expectValue(t, g, ";", MaybeValue{false, nil})
+
+	g.AddSymbol("START", Maybe(Literal("x")))
+	expectValue(t, g, "x", MaybeValue{true, "x"})
+	expectValue(t, g, "", MaybeValue{})
+}
+
+func TestPure(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Alt(Literal("x"), Pure("default")))
+	expectString(t, g, "x", "x")
+	expectString(t, g, "", "default")
+
+	// Pure must not consume anything.
+	g.AddSymbol("START", Seq(Alt(Literal("x"), Pure("default")), Literal("y")))
+	expectStrings(t, g, "y", []string{"default", "y"})
+}
+
+func TestFail(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Fail("no %s here", "dice"))
+	expectError(t, g, "abc", "no dice here")
+
+	g.AddSymbol("START", Alt(Fail("never"), Literal("a")))
+	expectString(t, g, "a", "a")
+}
+
+func TestMap(t *testing.T) {
+	toInt := func(res interface{}, loc *Loc) (interface{}, error) {
+		n := 0
+		for _, d := range res.([]interface{}) {
+			n = 10*n + int(d.(byte)-'0')
+		}
+		return n, nil
+	}
+
+	g := NewGrammar()
+	g.AddSymbol("START", SeqAt(1, Literal("["), Map(Many1(Range('0', '9')), toInt), Literal("]")))
+	r, err := g.ParseString("test", "[123]")
+	if err != nil {
+		t.Errorf("unexpected failure: %v", err)
+	}
+	if n, ok := r.(int); !ok || n != 123 {
+		t.Errorf("expected int 123, got %#v", r)
+	}
+
+	g.AddSymbol("START", Map(Literal("x"), func(res interface{}, loc *Loc) (interface{}, error) {
+		return nil, fmt.Errorf("bad %v", res)
+	}))
+	expectErrorAt(t, g, "x", 1, "bad x")
+}
+
+func TestLookAhead(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Seq(LookAhead(Literal("ab")), Literal("a"), Literal("b")))
+	expectStrings(t, g, "ab", []string{"ab", "a", "b"})
+	expectError(t, g, "ac", "expected literal 'ab'")
+
+	// Only the "a" is consumed, so the rest remains.
+	g.AddSymbol("START", Seq(LookAhead(Literal("ab")), Literal("a")))
+	expectErrorAt(t, g, "ab", 1, "incomplete parse, expected EOF but input remains: b")
+}
+
+func TestNotFollowedBy(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", SeqAt(0,
+		Literal("for"), NotFollowedBy(Range('a', 'z')), Literal("(")))
+	expectString(t, g, "for(", "for")
+	expectErrorAt(t, g, "format", 3, "unexpected m")
+
+	// NotFollowedBy consumes nothing, even on success.
+	g.AddSymbol("START", SeqAt(1, NotFollowedBy(Literal("x")), Literal("y")))
+	expectString(t, g, "y", "y")
+}
+
+func TestAddAction(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Literal("abc"))
+	g.AddAction("START", func(res interface{}, loc *Loc) (interface{}, error) {
+		return res.(string) + "!", nil
+	})
+	expectString(t, g, "abc", "abc!")
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected AddAction on a missing symbol to panic")
+		}
+	}()
+	g.AddAction("missing", func(res interface{}, loc *Loc) (interface{}, error) {
+		return res, nil
+	})
+}
+
+func TestAddRule(t *testing.T) {
+	g := NewGrammar()
+	digit := g.AddRule("digit", Range('0', '9'))
+	g.AddRule("START", Stringify(SepBy(digit, Literal(","))))
+	expectString(t, g, "1,2,3", "123")
+
+	// The returned Symbol sees later changes to the rule.
+	g.AddSymbol("digit", Range('a', 'z'))
+	expectString(t, g, "a,b", "ab")
+}
+
+func TestSepByTrailingSeparator(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("chunk",
+		SeqAt(1, Literal("["), Stringify(Many(Range('a', 'z'))), Literal("]")))
+	g.AddSymbol("START", SepBy(Symbol("chunk"), Literal(",")))
+	expectErrorAt(t, g, "[a],", 3, "incomplete parse, expected EOF but input remains: ,")
+	expectErrorAt(t, g, "[a],[b],", 7, "incomplete parse, expected EOF but input remains: ,")
+
+	// The trailing separator is left for the following parser.
+	g.AddSymbol("START", SeqAt(0, SepBy(Symbol("chunk"), Literal(",")), Literal(",")))
+	expectStrings(t, g, "[a],[b],", []string{"a", "b"})
+	expectStrings(t, g, ",", []string{})
+}
+
+func TestSepBy1Empty(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", SepBy1(Literal("a"), Literal(",")))
+	expectStrings(t, g, "a,a", []string{"a", "a"})
+	expectError(t, g, "", "expected at least 1: test line 1 col 0: expected literal 'a'")
+	expectError(t, g, "b", "expected at least 1: test line 1 col 0: expected literal 'a'")
+}
+
+func TestSepByN(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", SepByN(Integer(), Literal(","), 3, 3))
+	r, err := g.ParseString("test", "1,2,3")
+	if err != nil {
+		t.Errorf("unexpected failure: %v", err)
+	} else if got := fmt.Sprint(r); got != "[1 2 3]" {
+		t.Errorf("wrong result: %s", got)
+	}
+	expectErrorAt(t, g, "1,2", 3, "expected at least 3: test line 1 col 3: expected literal ','")
+	expectErrorAt(t, g, "1,2,3,4", 5, "incomplete parse, expected EOF but input remains: ,4")
+
+	g.AddSymbol("START", SepByN(Literal("a"), Literal(","), 0, 2))
+	expectStrings(t, g, "", []string{})
+	expectStrings(t, g, "a,a", []string{"a", "a"})
+
+	// Any negative max is unbounded, and so guarded against looping forever.
+	g.AddSymbol("START", SepByN(Literal("a"), Literal(","), 1, -5))
+	expectStrings(t, g, "a,a,a", []string{"a", "a", "a"})
+	g.AddSymbol("START", Seq(SepByN(Optional(Literal("a")), Optional(Literal(",")), 0, -2), Literal("y")))
+	expectErrorAt(t, g, "a,y", 2, `SepBy would loop forever: "a"? ","? matched without consuming input`)
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a max below the min to panic")
+		}
+	}()
+	SepByN(Literal("a"), Literal(","), 3, 2)
+}
+
+func TestCountSepBy(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Between(Literal("("), CountSepBy(2, Integer(), Literal(",")), Literal(")")))
+	r, err := g.ParseString("test", "(3,4)")
+	if err != nil {
+		t.Errorf("unexpected failure: %v", err)
+	} else if got := fmt.Sprint(r); got != "[3 4]" {
+		t.Errorf("wrong result: %s", got)
+	}
+	expectErrorAt(t, g, "(3)", 2, "expected at least 2: test line 1 col 2: expected literal ','")
+	expectErrorAt(t, g, "(3,4,5)", 4, "expected exactly 2, but found more")
+
+	g.AddSymbol("START", CountSepBy(0, Integer(), Literal(",")))
+	expectStrings(t, g, "", []string{})
+	expectError(t, g, "1", "expected exactly 0, but found more")
+}
+
+func TestEndBy1Empty(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", EndBy1(Literal("a"), Literal(";")))
+	expectStrings(t, g, "a;a;", []string{"a", "a"})
+	expectError(t, g, "", "expected at least 1: test line 1 col 0: expected literal 'a'")
+}
+
+// An item without its separator is left for whatever follows.
+func TestEndByUnterminated(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", SeqAt(0, EndBy(Literal("a"), Literal(";")), Literal("a")))
+	expectStrings(t, g, "a;a", []string{"a"})
+	expectStrings(t, g, "a", []string{})
+
+	g.AddSymbol("START", EndBy1(Literal("a"), Literal(";")))
+	expectErrorAt(t, g, "a", 0, "expected at least 1: test line 1 col 1: expected literal ';'")
+}
+
+func TestLabel(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("ident", Label("an identifier",
+		Stringify(Many1(Alt(Range('a', 'z'), Range('A', 'Z'))))))
+	g.AddSymbol("START", Alt(Symbol("ident"), Label("a number", Many1(Range('0', '9')))))
+	expectString(t, g, "abc", "abc")
+	expectError(t, g, "!", "expected one of an identifier, a number")
+
+	// A failure after consuming input keeps its own error.
+	g.AddSymbol("START", Label("a pair",
+		Seq(Literal("("), Symbol("ident"), Literal(","), Symbol("ident"), Literal(")"))))
+	expectError(t, g, "x", "expected a pair")
+	expectErrorAt(t, g, "(a,1)", 3, "expected an identifier")
+}
+
+func TestExpect(t *testing.T) {
+	g := NewGrammar()
+	pair := Seq(Literal("("), Stringify(Many1(Range('a', 'z'))), Literal(","),
+		Stringify(Many1(Range('a', 'z'))), Literal(")"))
+	g.AddSymbol("START", Expect("a pair", pair))
+	expectStrings(t, g, "(a,b)", []string{"(", "a", ",", "b", ")"})
+	expectError(t, g, "x", "expected a pair")
+
+	// Unlike Label, the expectation is forced after consuming input too, but
+	// still reported where the inner parser failed.
+	expectErrorAt(t, g, "(a,1)", 3, "minimum 1, expected a pair")
+	expectErrorAt(t, g, "(a;b)", 2, "expected a pair")
+
+	// Committed errors stay committed.
+	g.AddSymbol("START", Alt(Seq(Literal("("), Expect("a name", Cut(Literal("x")))), Literal("(y")))
+	expectErrorAt(t, g, "(y", 1, "expected a name")
+}
+
+func TestAltFurthestError(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Alt(
+		Literal("x"),
+		Seq(Literal("ab"), Literal("c")),
+		Literal("y")))
+	expectErrorAt(t, g, "abd", 2, "expected literal 'c'")
+	expectError(t, g, "z", "expected one of literal 'x', literal 'ab', literal 'y'")
+
+	// Branches which fail equally far along have their expectations merged.
+	g.AddSymbol("START", Alt(
+		Seq(Literal("a"), Literal("b")),
+		Seq(Literal("a"), Literal("c")),
+		Literal("x")))
+	expectErrorAt(t, g, "ad", 1, "expected one of literal 'b', literal 'c'")
+
+	// Branches with only a message keep it.
+	g.AddSymbol("START", Alt(OneOf("ab"), OneOf("xy")))
+	expectError(t, g, "z", "expected one of: ab; expected one of: xy")
+	g.AddSymbol("START", Alt(OneOf("ab"), Literal("x")))
+	expectError(t, g, "z", "expected one of: ab, expected literal 'x'")
+}
+
+func TestLocCompare(t *testing.T) {
+	a := &Loc{Line: 1, Col: 5}
+	b := &Loc{Line: 2, Col: 0}
+	c := &Loc{Line: 2, Col: 3}
+	if a.Compare(b) != -1 || b.Compare(a) != 1 || b.Compare(c) != -1 || c.Compare(c) != 0 {
+		t.Errorf("wrong Loc ordering")
+	}
+}
+
+func TestCut(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Alt(
+		Seq(Literal("a"), Cut(Literal("b"))),
+		Seq(Literal("a"), Literal("c"))))
+	expectStrings(t, g, "ab", []string{"a", "b"})
+	// Without the Cut, the second branch would match.
+	expectErrorAt(t, g, "ac", 1, "expected literal 'b'")
+
+	// Committed failures escape repetitions and Optional too.
+	g.AddSymbol("pair", Seq(Literal("\""), Cut(Seq(Literal("k\""), Literal(":")))))
+	g.AddSymbol("START", SeqAt(1, Literal("{"), Many(Symbol("pair")), Literal("}")))
+	expectErrorAt(t, g, "{\"k\":\"k\"}", 8, "expected literal ':'")
+	g.AddSymbol("START", SeqAt(1, Literal("{"), Optional(Symbol("pair")), Literal("}")))
+	expectErrorAt(t, g, "{\"k}", 2, "expected literal 'k\"'")
+	g.AddSymbol("START", SepBy(Symbol("pair"), Literal(",")))
+	expectErrorAt(t, g, "\"k\":,\"j", 6, "expected literal 'k\"'")
+}
+
+type identNode struct {
+	name      string
+	line, col int
+}
+
+func TestMapLoc(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("ws", ManyDrop(OneOf(" \n")))
+	g.WithActionLoc("ident", Stringify(Many1(Range('a', 'z'))),
+		func(res interface{}, loc *Loc) (interface{}, error) {
+			return identNode{res.(string), loc.Line, loc.Col}, nil
+		})
+	g.AddSymbol("START", SeqAt(1, Symbol("ws"), Symbol("ident"), Symbol("ws")))
+
+	r, err := g.ParseString("test", "\n  abc  ")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if n := r.(identNode); n.name != "abc" || n.line != 2 || n.col != 2 {
+		t.Errorf("wrong node: %#v", n)
+	}
+
+	// Map, by contrast, passes the location where the match ended.
+	g.AddSymbol("START", Map(Literal("abc"), func(res interface{}, loc *Loc) (interface{}, error) {
+		return loc.Col, nil
+	}))
+	r, _ = g.ParseString("test", "abc")
+	if r != 3 {
+		t.Errorf("expected Map to see the end location, got %v", r)
+	}
+}
+
+func TestSepEndBy(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", SepEndBy(Stringify(Many1(Range('0', '9'))), Literal(",")))
+	expectStrings(t, g, "1,2,3", []string{"1", "2", "3"})
+	expectStrings(t, g, "1,2,3,", []string{"1", "2", "3"})
+	expectStrings(t, g, "", []string{})
+	expectErrorAt(t, g, "1,,", 2, "incomplete parse, expected EOF but input remains: ,")
+
+	g.AddSymbol("START", SepEndBy1(Stringify(Many1(Range('0', '9'))), Literal(",")))
+	expectStrings(t, g, "12,", []string{"12"})
+	expectError(t, g, "", "expected at least 1: test line 1 col 0: minimum 1, expected range(0..9)")
+}
+
+func TestManyTillT(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", SeqAt(1, Literal("/*"),
+		ManyTillT(AnyChar(), Alt(Literal("*/"), EOF()))))
+
+	for _, c := range []struct {
+		input      string
+		body       int
+		terminator interface{}
+	}{
+		{"/* abc */", 5, "*/"},
+		{"/* abc", 4, nil},
+		{"/**/", 0, "*/"},
+	} {
+		r, err := g.ParseString("test", c.input)
+		if err != nil {
+			t.Errorf("%q: unexpected failure: %v", c.input, err)
+			continue
+		}
+		res := r.(ManyTillResult)
+		if len(res.Items) != c.body || res.Terminator != c.terminator {
+			t.Errorf("%q: got %d items ending with %v", c.input, len(res.Items), res.Terminator)
+		}
+	}
+}
+
+func TestManyTillInnerFailure(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", ManyTill(Range('a', 'z'), Literal(";")))
+	expectStrings(t, g, ";", []string{})
+	expectErrorAt(t, g, "ab1;", 2,
+		"failed to parse many test line 1 col 2: expected range(a..z)")
+
+	// A committed failure inside stays committed, so Alt doesn't backtrack.
+	g.AddSymbol("START", Alt(
+		ManyTill(SeqAt(1, Literal("a"), Cut(Literal("b"))), Literal(";")),
+		Stringify(Many(AnyChar()))))
+	expectStrings(t, g, "abab;", []string{"b", "b"})
+	expectErrorAt(t, g, "abac;", 2,
+		"failed to parse many test line 1 col 3: expected literal 'b'")
+
+	g.AddSymbol("START", ManyTill(Optional(Literal("a")), Literal(";")))
+	expectErrorAt(t, g, "aab;", 2, `ManyTill would loop forever: "a"? matched without consuming input`)
+}
+
+func TestSkipThen(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Skip(Literal("$"), Literal("x")))
+	expectString(t, g, "$x", "x")
+	expectError(t, g, "x", "expected literal '$'")
+	expectErrorAt(t, g, "$y", 1, "expected literal 'x'")
+
+	g.AddSymbol("START", Then(Literal("x"), Literal(";")))
+	expectString(t, g, "x;", "x")
+	expectErrorAt(t, g, "x", 1, "expected literal ';'")
+	expectError(t, g, ";", "expected literal 'x'")
+}
+
+func TestLiteralICMatching(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", LiteralIC("Select_1"))
+	expectString(t, g, "select_1", "Select_1")
+	expectString(t, g, "SELECT_1", "Select_1")
+	expectString(t, g, "sElEcT_1", "Select_1")
+	expectError(t, g, "select-1", "expected literal 'Select_1'")
+	expectError(t, g, "sel", "expected literal 'Select_1'")
+
+	// Only ASCII letters are folded; other bytes must match exactly.
+	g.AddSymbol("START", LiteralIC("café"))
+	expectString(t, g, "CAFé", "café")
+	expectError(t, g, "CAFÉ", "expected literal 'café'")
+}
+
+func BenchmarkLiteralIC(b *testing.B) {
+	g := NewGrammar()
+	g.AddSymbol("START", Many(LiteralIC("keyword ")))
+	input := strings.Repeat("KeyWord ", 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := g.ParseString("bench", input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Keywords("in", "int", "integer"))
+	expectString(t, g, "integer", "integer")
+	expectString(t, g, "int", "int")
+	expectString(t, g, "in", "in")
+	expectErrorAt(t, g, "integ", 3, "incomplete parse, expected EOF but input remains: eg")
+	expectError(t, g, "i", "expected one of literal 'in', literal 'int', literal 'integer'")
+
+	g.AddSymbol("START", Seq(Keywords("for", "if", "else"), Literal(" "), Keywords("if", "else")))
+	expectStrings(t, g, "else if", []string{"else", " ", "if"})
+}
+
+var benchKeywords = []string{"break", "case", "chan", "const", "continue", "default", "defer",
+	"else", "fallthrough", "for", "func", "go", "goto", "if", "import", "interface", "map",
+	"package", "range", "return", "select", "struct", "switch", "type", "var"}
+
+func benchmarkKeywords(b *testing.B, p Parser) {
+	g := NewGrammar()
+	g.AddSymbol("START", Many(Seq(p, Literal(" "))))
+	input := strings.Repeat(strings.Join(benchKeywords, " ")+" ", 40)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := g.ParseString("bench", input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkKeywords(b *testing.B) { benchmarkKeywords(b, Keywords(benchKeywords...)) }
+
+// The naive equivalent, with the longest words first so that each matches in
+// full.
+func BenchmarkKeywordsAlt(b *testing.B) {
+	words := append([]string(nil), benchKeywords...)
+	sort.SliceStable(words, func(i, j int) bool { return len(words[i]) > len(words[j]) })
+	alts := make([]Parser, len(words))
+	for i, w := range words {
+		alts[i] = Literal(w)
+	}
+	benchmarkKeywords(b, Alt(alts...))
+}
+
+func TestAltVerbose(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", AltVerbose(
+		Literal("x"),
+		Seq(Literal("a"), Literal("b")),
+		OneOf("yz")))
+	expectString(t, g, "x", "x")
+	expectError(t, g, "ac", "no alternative matched:\n"+
+		"\t1: test line 1 col 0: expected literal 'x'\n"+
+		"\t2: test line 1 col 1: expected literal 'b'\n"+
+		"\t3: test line 1 col 0: expected one of: yz")
+}
+
+func TestLazy(t *testing.T) {
+	// Balanced brackets, counting the pairs, with no Symbols involved.
+	var brackets Parser
+	brackets = Map(Many(Between(Literal("["), Lazy(func() Parser { return brackets }), Literal("]"))),
+		func(res interface{}, loc *Loc) (interface{}, error) {
+			n := 0
+			for _, inner := range res.([]interface{}) {
+				n += 1 + inner.(int)
+			}
+			return n, nil
+		})
+
+	g := NewGrammar()
+	g.AddSymbol("START", brackets)
+	for input, pairs := range map[string]int{"": 0, "[]": 1, "[[]][]": 3, "[[[]][[]]]": 5} {
+		r, err := g.ParseString("test", input)
+		if err != nil || r != pairs {
+			t.Errorf("%q: expected %d pairs, got %v %v", input, pairs, r, err)
+		}
+	}
+	expectError(t, g, "[[]", "incomplete parse, expected EOF but input remains: [[]")
+}
+
+func TestRuleSet(t *testing.T) {
+	rules := NewRuleSet()
+	expr, term, factor := rules.Define("expr"), rules.Define("term"), rules.Define("factor")
+	sum := func(v interface{}) int {
+		n := 0
+		for _, x := range v.([]interface{}) {
+			n += x.(int)
+		}
+		return n
+	}
+	product := func(v interface{}) int {
+		n := 1
+		for _, x := range v.([]interface{}) {
+			n *= x.(int)
+		}
+		return n
+	}
+	rules.Set("expr", Map(SepBy1(term, Literal("+")),
+		func(res interface{}, loc *Loc) (interface{}, error) { return sum(res), nil }))
+	rules.Set("term", Map(SepBy1(factor, Literal("*")),
+		func(res interface{}, loc *Loc) (interface{}, error) { return product(res), nil }))
+	rules.Set("factor", Alt(Integer(), Between(Literal("("), expr, Literal(")"))))
+
+	g := NewGrammar()
+	g.AddSymbol("START", expr)
+	expectValue(t, g, "1+2*3", 7)
+	expectValue(t, g, "(1+2)*3", 9)
+	expectValue(t, g, "2*(3+(4*5))", 46)
+	expectErrorAt(t, g, "1+", 1, "incomplete parse, expected EOF but input remains: +")
+
+	if rules.Define("expr") != expr {
+		t.Errorf("expected Define to return the same rule again")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected an unset rule to panic")
+		}
+	}()
+	g.AddSymbol("START", rules.Define("missing"))
+	g.ParseString("test", "x")
+}
+
+func TestOptionDefault(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", SeqAt(0, OptionDefault("", Literal("x")), Literal(";")))
+	expectString(t, g, "x;", "x")
+	expectString(t, g, ";", "")
+
+	g.AddSymbol("START", OptionDefault(0, Integer()))
+	expectValue(t, g, "", 0)
+	expectValue(t, g, "12", 12)
+}
+
+func TestMany1Drop(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Many1Drop(Literal(" ")))
+	expectNil(t, g, "   ")
+	expectError(t, g, "", "minimum 1, expected literal ' '")
+
+	g.AddSymbol("START", SeqAt(1, Literal("a"), Many1Drop(Literal(" ")), Literal("b")))
+	expectNil(t, g, "a   b")
+	expectErrorAt(t, g, "ab", 1, "minimum 1, expected literal ' '")
+}
+
+func TestParsePrefix(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("expr", Integer())
+
+	v, rest, err := g.ParsePrefix("test", "42 rest", "expr")
+	if err != nil || v != 42 || rest != " rest" {
+		t.Errorf("got %v, %q, %v", v, rest, err)
+	}
+
+	v, rest, err = g.ParsePrefix("test", "42", "expr")
+	if err != nil || v != 42 || rest != "" {
+		t.Errorf("got %v, %q, %v", v, rest, err)
+	}
+
+	_, rest, err = g.ParsePrefix("test", "x42", "expr")
+	if err == nil || err.Error() != "test line 1 col 0: expected integer" || rest != "x42" {
+		t.Errorf("expected failure, got %q, %v", rest, err)
+	}
+}
+
+func TestMustParseString(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Integer())
+	if v := g.MustParseString("test", "12"); v != 12 {
+		t.Errorf("expected 12, got %v", v)
+	}
+
+	defer func() {
+		r := recover()
+		if r != "psec: MustParseString: test line 1 col 0: expected integer" {
+			t.Errorf("wrong panic: %v", r)
+		}
+	}()
+	g.MustParseString("test", "x")
+}
+
+func TestFormatWithSource(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", SepBy(Lexeme(Stringify(Many1(Alt(Letter(), RuneRange('à', 'ÿ'))))), Tok(";")))
+
+	src := "abc;\n\tdéf ghi;\nxyz"
+	_, err := g.ParseString("test", src)
+	if err == nil {
+		t.Fatalf("expected failure")
+	}
+	want := "test line 2 col 5: incomplete parse, expected EOF but input remains: ghi;\nxyz\n" +
+		"\tdéf ghi;\n" +
+		"\t    ^"
+	if got := err.(*ParseError).FormatWithSource(src); got != want {
+		t.Errorf("wrong formatting:\n%s", got)
+	}
+
+	// Past the end of the source, there's no line to show.
+	e := (&Loc{Filename: "test", Line: 9, Col: 0}).mkErrorMessage("oops")
+	if got := e.FormatWithSource(src); got != "test line 9 col 0: oops" {
+		t.Errorf("wrong formatting: %s", got)
+	}
+}
+
+func TestEndOfLine(t *testing.T) {
+	g := NewGrammar()
+	line := SeqAt(0, TakeWhile1(isAlnum), EndOfLine())
+	g.AddSymbol("START", SeqAt(0, Many(line), EOF()))
+	expectStrings(t, g, "ab\ncd\r\nef", []string{"ab", "cd", "ef"})
+	expectStrings(t, g, "ab\n", []string{"ab"})
+	expectErrorAt(t, g, "ab\rcd", 0, "expected end of input")
+
+	g.AddSymbol("START", Seq(line, AtLineStart(line), Position()))
+	r, err := g.ParseString("test", "ab\r\ncd\n")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if loc := r.([]interface{})[2].(*Loc); loc.Line != 3 || loc.Col != 0 {
+		t.Errorf("expected to end at line 3 col 0, got %v", loc)
+	}
+
+	g.AddSymbol("START", Then(Literal("ab"), EndOfLine()))
+	expectErrorAt(t, g, "ab\r", 2, "expected end of line")
+	expectErrorAt(t, g, "abc", 2, "expected end of line")
+}
+
+func TestAtLineStart(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("heading", AtLineStart(SeqAt(1, Literal("# "), Stringify(Many1(NoneOf("\n"))))))
+	g.AddSymbol("START", Symbol("heading"))
+	expectString(t, g, "# title", "title")
+
+	g.AddSymbol("START", Seq(Literal("x"), Symbol("heading")))
+	expectErrorAt(t, g, "x# title", 1, "expected start of line")
+
+	g.AddSymbol("START", SepBy(Alt(Symbol("heading"), Stringify(Many1(NoneOf("\n")))), Literal("\n")))
+	expectStrings(t, g, "text # not\n# title", []string{"text # not", "title"})
+}
+
+func TestPosition(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", SeqAt(1, Literal("\n  "), Seq(Position(), Literal("x"))))
+	r, err := g.ParseString("test", "\n  x")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	res := r.([]interface{})
+	if loc := res[0].(*Loc); loc.Line != 2 || loc.Col != 2 || loc.Offset != 3 {
+		t.Errorf("expected line 2 col 2, offset 3, got %v", loc)
+	}
+	if res[1] != "x" {
+		t.Errorf("expected x, got %v", res[1])
+	}
+}
+
+func TestPeek(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Seq(Peek(), AnyChar()))
+	r, err := g.ParseString("test", "q")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if rs := r.([]interface{}); rs[0] != byte('q') || rs[1] != byte('q') {
+		t.Errorf("expected the same byte twice, got %v", rs)
+	}
+
+	g.AddSymbol("START", Peek())
+	expectNil(t, g, "")
+}
+
+func TestFold(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Fold(Digit(), 0, func(acc, v interface{}) interface{} {
+		return acc.(int) + int(v.(byte)-'0')
+	}))
+	expectValue(t, g, "", 0)
+	expectValue(t, g, "123", 6)
+	expectValue(t, g, strings.Repeat("9", 10000), 90000)
+}
+
+func TestManyRange(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Stringify(ManyRange(Digit(), 2, 4)))
+	expectString(t, g, "12", "12")
+	expectString(t, g, "123", "123")
+	expectString(t, g, "1234", "1234")
+	expectErrorAt(t, g, "1", 1, "minimum 2, expected digit")
+	expectErrorAt(t, g, "12345", 4, "incomplete parse, expected EOF but input remains: 5")
+
+	// Stopping at the maximum leaves the rest for the next parser.
+	g.AddSymbol("START", Seq(Stringify(ManyRange(Digit(), 2, 4)), Stringify(Many(Digit()))))
+	expectStrings(t, g, "123456", []string{"1234", "56"})
+	expectStrings(t, g, "12", []string{"12", ""})
+
+	g.AddSymbol("START", Stringify(ManyRange(Digit(), 2, -1)))
+	expectString(t, g, "123456", "123456")
+	g.AddSymbol("START", Stringify(ManyRange(Digit(), 2, -3)))
+	expectString(t, g, "123456", "123456")
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a max below the min to panic")
+		}
+	}()
+	ManyRange(Digit(), 3, 2)
+}
+
+func TestKeyword(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Then(Keyword("if", Range('a', 'z')), Literal(" ")))
+	expectString(t, g, "if ", "if")
+	expectError(t, g, "iffy", "expected keyword 'if'")
+	expectError(t, g, "of ", "expected keyword 'if'")
+
+	g.AddSymbol("START", Keyword("if", Range('a', 'z')))
+	expectString(t, g, "if", "if")
+}
+
+func TestOffset(t *testing.T) {
+	input := "ab\ncé!"
+	streams := map[string]Stream{
+		"string": &stringPS{str: input, line: 1},
+		"bytes":  &bytesPS{data: []byte(input), line: 1},
+		"reader": &readerPS{src: &readerSource{r: strings.NewReader(input)}, line: 1},
+	}
+	for name, ps := range streams {
+		for i := 0; i < len(input); i++ {
+			if ps.Offset() != i || ps.Loc().Offset != i {
+				t.Errorf("%s: expected offset %d, got %d", name, i, ps.Offset())
+			}
+			ps = ps.Tail()
+		}
+		if ps.Offset() != len(input) {
+			t.Errorf("%s: expected offset %d at EOF, got %d", name, len(input), ps.Offset())
+		}
+	}
+
+	// Actions can see how far a partial parse got.
+	g := NewGrammar()
+	g.AddSymbol("word", Map(Many1(Alt(Letter(), RuneRange('à', 'ÿ'))), func(res interface{}, loc *Loc) (interface{}, error) {
+		return loc.Offset, nil
+	}))
+	v, rest, err := g.ParsePrefix("test", "héllo world", "word")
+	if err != nil || v != len("héllo") || rest != " world" {
+		t.Errorf("got %v, %q, %v", v, rest, err)
+	}
+}
+
+func TestNested(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Nested(Literal("("), Literal(")"), Letter()))
+	for input, want := range map[string]string{
+		"()":         "[]",
+		"(a)":        "[97]",
+		"((a)(b))":   "[[97] [98]]",
+		"(a(b(c))d)": "[97 [98 [99]] 100]",
+	} {
+		r, err := g.ParseString("test", input)
+		if err != nil {
+			t.Errorf("%q: unexpected failure: %v", input, err)
+		} else if got := fmt.Sprint(r); got != want {
+			t.Errorf("%q: expected %s, got %s", input, want, got)
+		}
+	}
+
+	expectErrorAt(t, g, "((a)", 4, "unclosed '(' opened at line 1 col 0, expected literal ')'")
+	expectErrorAt(t, g, "((a)(b", 6, "unclosed '(' opened at line 1 col 4, expected literal ')'")
+	expectErrorAt(t, g, "(a1)", 2, "unclosed '(' opened at line 1 col 0, expected literal ')'")
+	expectErrorAt(t, g, "(a))", 3, "incomplete parse, expected EOF but input remains: )")
+}
+
+// Matches a run of one or more copies of the same byte.
+var sameRun = ParserFunc(func(s Stream) (Stream, error) {
+	first, eof := s.Head()
+	if eof {
+		return nil, s.Loc().Expected("run")
+	}
+	n := 0
+	for {
+		c, eof := s.Head()
+		if eof || c != first {
+			break
+		}
+		s = s.Tail()
+		n++
+	}
+	if n < 2 {
+		return nil, s.Loc().Errorf("run of %c too short", first)
+	}
+	return s.SetValue(n), nil
+})
+
+func TestParserFunc(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Many(sameRun))
+	r, err := g.ParseString("test", "aaabbcccc")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if got := fmt.Sprint(r); got != "[3 2 4]" {
+		t.Errorf("wrong runs: %s", got)
+	}
+
+	g.AddSymbol("START", sameRun)
+	expectErrorAt(t, g, "ab", 1, "run of a too short")
+	g.AddSymbol("START", Alt(sameRun, Literal("x")))
+	expectError(t, g, "", "expected one of run, literal 'x'")
+
+	g.AddSymbol("START", ParserFunc(func(s Stream) (Stream, error) {
+		return nil, fmt.Errorf("plain error")
+	}))
+	expectError(t, g, "abc", "plain error")
+}
+
+func TestParseErrorAccessors(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Seq(Literal("ab"), Alt(Literal("c"), Literal("d"))))
+	_, err := g.ParseString("test", "abx")
+	pe, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("expected a *ParseError, got %T", err)
+	}
+	if pe.Loc().Line != 1 || pe.Loc().Col != 2 || pe.Loc().Filename != "test" {
+		t.Errorf("wrong location: %v", pe.Loc())
+	}
+	if got := fmt.Sprint(pe.Expected()); got != "[literal 'c' literal 'd']" {
+		t.Errorf("wrong expectations: %s", got)
+	}
+	if pe.Message() != "" {
+		t.Errorf("unexpected message: %s", pe.Message())
+	}
+
+	g.AddSymbol("START", Fail("nope"))
+	_, err = g.ParseString("test", "")
+	if pe := err.(*ParseError); pe.Message() != "nope" || len(pe.Expected()) != 0 {
+		t.Errorf("wrong message error: %#v", pe)
+	}
+}
+
+func TestSepByWithSeps(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", SepByWithSeps(Integer(), Stringify(Many1(OneOf(" ,;")))))
+
+	r, err := g.ParseString("test", "1, 2;3 ,4")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	res := r.(Separated)
+	if got := fmt.Sprint(res.Items); got != "[1 2 3 4]" {
+		t.Errorf("wrong items: %s", got)
+	}
+	if got := fmt.Sprintf("%q", res.Seps); got != `[", " ";" " ,"]` {
+		t.Errorf("wrong separators: %s", got)
+	}
+	if len(res.Items) != len(res.Seps)+1 {
+		t.Errorf("expected one more item than separators")
+	}
+
+	r, _ = g.ParseString("test", "")
+	if res := r.(Separated); len(res.Items) != 0 || len(res.Seps) != 0 {
+		t.Errorf("expected empty result, got %v", res)
+	}
+	expectErrorAt(t, g, "1, ", 1, "incomplete parse, expected EOF but input remains: , ")
+}
+
+func TestCaptured(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Captured(Seq(Integer(), Literal("."), Integer())))
+	expectString(t, g, "3.14", "3.14")
+	expectErrorAt(t, g, "3.x", 2, "expected integer")
+
+	// The text is verbatim, including anything the inner parser skipped.
+	g.AddSymbol("START", Captured(SepBy(Lexeme(Integer()), Tok(","))))
+	expectString(t, g, "1 ,2,  3", "1 ,2,  3")
+	expectString(t, g, "", "")
+}
+
+func TestWithSpan(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Skip(Literal("x = "), WithSpan(Float())))
+	r, err := g.ParseString("test", "x = 2.5e3")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	s := r.(Span)
+	if s.Value != 2500.0 || s.Text != "2.5e3" {
+		t.Errorf("wrong value or text: %v %q", s.Value, s.Text)
+	}
+	if s.Start.Col != 4 || s.End.Col != 9 || s.End.Offset-s.Start.Offset != len(s.Text) {
+		t.Errorf("inconsistent span: %v to %v for %q", s.Start, s.End, s.Text)
+	}
+
+	// Spans can cover several lines.
+	g.AddSymbol("START", WithSpan(Many(Alt(Letter(), Literal("\n")))))
+	r, _ = g.ParseString("test", "ab\ncd")
+	s = r.(Span)
+	if s.Text != "ab\ncd" || s.Start.Line != 1 || s.End.Line != 2 || s.End.Col != 2 {
+		t.Errorf("wrong multi-line span: %v to %v for %q", s.Start, s.End, s.Text)
+	}
+}
+
+func TestManyLazy(t *testing.T) {
+	text := func(res interface{}, loc *Loc) (interface{}, error) {
+		parts := res.([]interface{})
+		return concatText(parts[1]) + "|" + concatText(parts[3]), nil
+	}
+	g := NewGrammar()
+	g.AddSymbol("START", Map(Seq(Literal("<!--"), ManyLazy(AnyChar()), Literal("-->"), Many(AnyChar())), text))
+	expectString(t, g, "<!--a-b-->c-->", "a-b|c-->")
+	expectString(t, g, "<!---->", "|")
+	expectErrorAt(t, g, "<!--abc", 7, "expected literal '-->'")
+
+	// Greedy Many runs to the end of the input, leaving nothing for "-->".
+	g.AddSymbol("START", Map(Seq(Literal("<!--"), Many(AnyChar()), Literal("-->"), Many(AnyChar())), text))
+	expectErrorAt(t, g, "<!--a-b-->c-->", 14, "expected literal '-->'")
+
+	// Lazy repetition works in SeqAt and Between, too.
+	g.AddSymbol("START", Stringify(SeqAt(0, ManyLazy(Letter()), Literal("x"), Many(Letter()))))
+	expectString(t, g, "abxyxz", "ab")
+
+	// Last in a Seq, it has nothing to stop for, so it matches nothing.
+	g.AddSymbol("START", SeqAt(0, Letter(), ManyLazy(Letter())))
+	expectValue(t, g, "a", byte('a'))
+	expectErrorAt(t, g, "ab", 1, "incomplete parse, expected EOF but input remains: b")
+
+	// Wrapped, it can't see the rest of the Seq. The error is committed, so
+	// Optional doesn't hide it.
+	g.AddSymbol("START", Seq(Stringify(ManyLazy(AnyChar())), Literal("x")))
+	expectError(t, g, "abx", "AnyChar*? must be directly inside a Seq, SeqAt or Between")
+	g.AddSymbol("START", Seq(Literal("a"), Optional(ManyLazy(AnyChar())), Literal("x")))
+	expectErrorAt(t, g, "abx", 1, "AnyChar*? must be directly inside a Seq, SeqAt or Between")
+}
+
+func TestVerify(t *testing.T) {
+	octet := Verify(Integer(), func(v interface{}) bool {
+		n := v.(int)
+		return n >= 0 && n <= 255
+	}, "octet must be between 0 and 255")
+	g := NewGrammar()
+	g.AddSymbol("START", SepByN(octet, Literal("."), 4, 4))
+	r, err := g.ParseString("test", "192.168.0.1")
+	if err != nil {
+		t.Errorf("unexpected failure: %v", err)
+	} else if got := fmt.Sprint(r); got != "[192 168 0 1]" {
+		t.Errorf("wrong result: %s", got)
+	}
+
+	g.AddSymbol("START", Then(Literal("x="), octet))
+	expectErrorAt(t, g, "x=300", 2, "octet must be between 0 and 255")
+	expectErrorAt(t, g, "x=y", 2, "expected integer")
+}
+
+func TestMemoize(t *testing.T) {
+	runs := 0
+	counted := Seq(ParserFunc(func(s Stream) (Stream, error) {
+		runs++
+		return s, nil
+	}), Stringify(Many1(Letter())))
+
+	// Both branches parse a word at the same position, so without Memoize the
+	// word is parsed twice.
+	g := NewGrammar()
+	g.AddSymbol("word", counted)
+	g.AddSymbol("START", Alt(
+		SeqAt(0, Symbol("word"), Literal("!")),
+		SeqAt(0, Symbol("word"), Literal("?"))))
+	if _, err := g.ParseString("test", "hello?"); err != nil {
+		t.Errorf("unexpected failure: %v", err)
+	}
+	if runs != 2 {
+		t.Errorf("expected 2 runs without Memoize, got %d", runs)
+	}
+
+	g.AddSymbol("word", Memoize("word", counted))
+	runs = 0
+	if _, err := g.ParseString("test", "hello?"); err != nil {
+		t.Errorf("unexpected failure: %v", err)
+	}
+	if runs != 1 {
+		t.Errorf("expected 1 run with Memoize, got %d", runs)
+	}
+
+	// The cache doesn't outlive the parse.
+	if _, err := g.ParseString("test", "hello?"); err != nil {
+		t.Errorf("unexpected failure: %v", err)
+	}
+	if runs != 2 {
+		t.Errorf("expected a fresh cache for each parse, got %d runs", runs)
+	}
+}
+
+func TestManyLazyBetween(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Stringify(Between(Literal("<"), ManyLazy(AnyChar()), Literal(">"))))
+	expectString(t, g, "<a<b>", "a<b")
+	expectErrorAt(t, g, "<ab", 3, "unclosed '<' opened at line 1 col 0, expected literal '>'")
 }
@@ -0,0 +1,124 @@
+package psec
+
+import "io"
+
+// readerSource is the buffer shared by all the readerPS streams over a single
+// io.Reader. Input is read on demand, in chunks.
+//
+// Since parsers may backtrack to any earlier position, every byte read is kept
+// until the parse is over. That means parsing from a Reader still ends up
+// holding the whole input in memory; what it saves is reading all of it up
+// front, and the input can be abandoned early if the parse fails.
+type readerSource struct {
+	r   io.Reader
+	buf []byte
+	err error // First error returned by r, including io.EOF.
+}
+
+const readerChunkSize = 4096
+
+// fill reads more input until pos is buffered, returning false if the input
+// ends first.
+func (src *readerSource) fill(pos uint) bool {
+	for uint(len(src.buf)) <= pos {
+		if src.err != nil {
+			return false
+		}
+		if cap(src.buf)-len(src.buf) < readerChunkSize {
+			grown := make([]byte, len(src.buf), 2*cap(src.buf)+readerChunkSize)
+			copy(grown, src.buf)
+			src.buf = grown
+		}
+		n, err := src.r.Read(src.buf[len(src.buf):cap(src.buf)])
+		src.buf = src.buf[:len(src.buf)+n]
+		src.err = err
+	}
+	return true
+}
+
+// readerPS is a Stream over an io.Reader. Like stringPS, it is treated as
+// immutable, and all the streams for one input share a readerSource.
+type readerPS struct {
+	src      *readerSource
+	pos      uint
+	filename string
+	line     int
+	col      int
+	value    interface{}
+	state    interface{}
+	tail     *readerPS
+}
+
+func (s *readerPS) Head() (byte, bool) {
+	if !s.src.fill(s.pos) {
+		return 0, true
+	}
+	return s.src.buf[s.pos], false
+}
+
+func (s *readerPS) Tail() Stream {
+	if s.tail == nil {
+		s.src.fill(s.pos)
+		s.tail = &readerPS{
+			src:      s.src,
+			pos:      s.pos + 1,
+			filename: s.filename,
+			state:    s.state,
+		}
+		s.tail.line, s.tail.col = advanceLoc(s.line, s.col, s.src.buf[s.pos])
+	}
+	return s.tail
+}
+
+func (s *readerPS) Value() interface{} { return s.value }
+func (s *readerPS) SetValue(v interface{}) Stream {
+	dup := *s
+	dup.value = v
+	return &dup
+}
+
+func (s *readerPS) State() interface{} { return s.state }
+func (s *readerPS) SetState(st interface{}) Stream {
+	dup := *s
+	dup.state = st
+	dup.tail = nil // The cached tail carries the old state.
+	return &dup
+}
+
+func (s *readerPS) Loc() *Loc {
+	return &Loc{Filename: s.filename, Line: s.line, Col: s.col, Offset: int(s.pos)}
+}
+
+func (s *readerPS) Offset() int { return int(s.pos) }
+
+// RemainingInput has to read the rest of the input to return it.
+func (s *readerPS) RemainingInput() string {
+	for s.src.fill(uint(len(s.src.buf))) {
+	}
+	return string(s.src.buf[s.pos:])
+}
+
+// textTo only needs input that has already been read, to reach to.
+func (s *readerPS) textTo(to Stream) string {
+	return string(s.src.buf[s.pos:to.Offset()])
+}
+
+// ParseReader is a variant of ParseString that reads its input from an
+// io.Reader as the parse needs it. See readerSource for the memory trade-off.
+// If reading fails with anything other than io.EOF, that error is returned.
+//
+// A few parsers need the rest of the input, and so read all of it when they're
+// run: Regexp, symbols cached with SetCache, and the error from a parse that
+// doesn't reach the end, which quotes what remains.
+func (g *Grammar) ParseReader(filename string, r io.Reader) (interface{}, error) {
+	src := &readerSource{r: r}
+	res, err := g.parse(&readerPS{
+		src:      src,
+		filename: filename,
+		line:     1,
+	}, g.startSymbol, g.newContext())
+	if src.err != nil && src.err != io.EOF {
+		return nil, src.err
+	}
+	return res, err
+}
@@ -0,0 +1,99 @@
+package psec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParseReader(t *testing.T) {
+	inputs := []string{
+		"{ \"arr\": [1,-8], \"obj\":{\"k\":\"v\"}, \"empty\"  : {} }",
+		"   [   77, \"str here\", false   ]   ",
+		"[1, 2",
+	}
+	for _, in := range inputs {
+		want, wantErr := grammar.ParseString("test", in)
+		// OneByteReader makes sure values span many reads.
+		got, gotErr := grammar.ParseReader("test", iotest.OneByteReader(strings.NewReader(in)))
+		if fmt.Sprint(want) != fmt.Sprint(got) {
+			t.Errorf("%q: ParseReader gave %v, ParseString gave %v", in, got, want)
+		}
+		if fmt.Sprint(wantErr) != fmt.Sprint(gotErr) {
+			t.Errorf("%q: ParseReader error %v, ParseString error %v", in, gotErr, wantErr)
+		}
+	}
+}
+
+func TestParseReaderLarge(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("[")
+	for i := 0; i < 5000; i++ {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%d", i)
+	}
+	sb.WriteString("]")
+
+	res, err := grammar.ParseReader("test", strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	arr := res.([]interface{})
+	if len(arr) != 5000 || arr[4999].(int) != 4999 {
+		t.Errorf("bad result: %d items", len(arr))
+	}
+}
+
+func TestParseReaderError(t *testing.T) {
+	boom := errors.New("boom")
+	r := io.MultiReader(strings.NewReader("[1, "), iotest.ErrReader(boom))
+	if _, err := grammar.ParseReader("test", r); err != boom {
+		t.Errorf("expected read error, got %v", err)
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// Parsers which take the text they matched mustn't read the rest of the input
+// to do it.
+func TestParseReaderMatchedText(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Seq(Captured(Between(Literal("("), TakeWhile1(isAlphaNum), Literal(")"))),
+		WithSpan(Literal("?")), Literal("!")))
+	r := &countingReader{r: strings.NewReader("(abc)?" + strings.Repeat("x", 1<<20))}
+	_, err := g.ParseReader("test", r)
+	if err == nil || err.Error() != "test line 1 col 6: expected literal '!'" {
+		t.Errorf("wrong error: %v", err)
+	}
+	if r.n > 2*readerChunkSize {
+		t.Errorf("expected only the start of the input to be read, but read %d bytes", r.n)
+	}
+}
+
+func TestParseReaderKeyword(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Seq(Alt(Keyword("if", AlphaNum()), Literal("iffy")), Literal("!")))
+	r := &countingReader{r: strings.NewReader("iffy?" + strings.Repeat("x", 1<<20))}
+	_, err := g.ParseReader("test", r)
+	if err == nil || err.Error() != "test line 1 col 4: expected literal '!'" {
+		t.Errorf("wrong error: %v", err)
+	}
+	if r.n > 2*readerChunkSize {
+		t.Errorf("expected only the start of the input to be read, but read %d bytes", r.n)
+	}
+}
@@ -0,0 +1,81 @@
+package psec
+
+import "fmt"
+
+// ErrorNode is the value Recover yields in place of its inner parser's value
+// when that parser fails: it holds the error, so that a parse can carry on and
+// report every mistake in the input, rather than stopping at the first.
+type ErrorNode struct {
+	Err *ParseError
+}
+
+// Recover runs p, and if it fails, records the error in an ErrorNode and skips
+// ahead to resynchronize: it consumes input from where p started up to and
+// including the next match of sync, and succeeds there with the ErrorNode as its
+// value. For example, Many(Recover(statement, Literal(";"))) parses a whole
+// file of statements, skipping over broken ones to the next ";".
+// Recover catches committed errors too, since those are the deep failures it's
+// designed to recover from.
+// If no sync is found, Recover skips to the end of the input. But if p failed
+// at the end of the input, there's nothing to skip, and Recover fails with p's
+// error; that lets Many and friends stop there.
+// The errors Recover catches are also collected for Grammar.ParseStringAll.
+func Recover(p, sync Parser) Parser {
+	return &pRecover{p, sync}
+}
+
+type pRecover struct {
+	inner, sync Parser
+}
+
+func (p *pRecover) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	res, err := p.inner.Parse(ps, g)
+	if err == nil || g.aborted != nil {
+		return res, err
+	}
+
+	for cur := ps; ; cur = cur.Tail() {
+		next, _ := p.sync.Parse(cur, g)
+		if next == nil {
+			if !atEnd(cur) {
+				continue
+			}
+			if cur == ps {
+				return nil, err
+			}
+			next = cur
+		}
+		g.recovered = append(g.recovered, err)
+		return next.SetValue(ErrorNode{err}), nil
+	}
+}
+
+func (p *pRecover) describe() string {
+	return fmt.Sprintf("Recover(%s, %s)", describe(p.inner), describe(p.sync))
+}
+
+// ParseStringAll is a variant of ParseString for reporting every error in the
+// input at once: it returns all the errors caught by Recover parsers during the
+// parse, in the order they were found. If the parse as a whole fails too, that
+// error comes last, and the value is nil.
+// Errors are recorded as Recover catches them, so one inside a branch that is
+// later backtracked out of is still reported. Place Recover where the grammar
+// has committed, eg. around whole statements.
+func (g *Grammar) ParseStringAll(filename, str string) (interface{}, []error) {
+	ctx := g.newContext()
+	v, err := g.parse(&stringPS{
+		str:      str,
+		filename: filename,
+		line:     1,
+		arena:    new(streamArena),
+	}, g.startSymbol, ctx)
+
+	var errs []error
+	for _, e := range ctx.recovered {
+		errs = append(errs, e)
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return v, errs
+}
@@ -0,0 +1,95 @@
+package psec
+
+import "testing"
+
+// Statements of the form "name=123;", where broken statements are skipped up to
+// the next ";".
+func buildRecoverGrammar() *Grammar {
+	g := NewGrammar()
+	g.AddSymbol("stmt", Seq(
+		Stringify(Many1(Range('a', 'z'))),
+		Cut(SeqAt(1, Literal("="), Integer(), Literal(";")))))
+	g.AddSymbol("START", Many(Recover(Symbol("stmt"), Literal(";"))))
+	return g
+}
+
+func TestRecover(t *testing.T) {
+	g := buildRecoverGrammar()
+
+	r, err := g.ParseString("test", "a=1;b=;c=3;d=4x;e=5;")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	stmts := r.([]interface{})
+	if len(stmts) != 5 {
+		t.Fatalf("expected 5 statements, got %d: %v", len(stmts), stmts)
+	}
+
+	var errs []*ParseError
+	for _, s := range stmts {
+		if node, ok := s.(ErrorNode); ok {
+			errs = append(errs, node.Err)
+		}
+	}
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %d: %v", len(errs), errs)
+	}
+	if got := errs[0].Error(); got != "test line 1 col 6: expected integer" {
+		t.Errorf("wrong first error: %s", got)
+	}
+	if got := errs[1].Error(); got != "test line 1 col 14: expected literal ';'" {
+		t.Errorf("wrong second error: %s", got)
+	}
+	if v := stmts[4].([]interface{}); v[0] != "e" || v[1] != 5 {
+		t.Errorf("expected parsing to resume after the errors, got %v", v)
+	}
+}
+
+func TestRecoverToEOF(t *testing.T) {
+	g := buildRecoverGrammar()
+
+	r, err := g.ParseString("test", "a=1;b")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	stmts := r.([]interface{})
+	if len(stmts) != 2 {
+		t.Fatalf("expected 2 statements, got %v", stmts)
+	}
+	if _, ok := stmts[1].(ErrorNode); !ok {
+		t.Errorf("expected the unterminated statement to be an ErrorNode, got %v", stmts[1])
+	}
+}
+
+func TestParseStringAll(t *testing.T) {
+	g := buildRecoverGrammar()
+
+	_, errs := g.ParseStringAll("test", "a=1;b=;c=3;d=4x;e=5;")
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %d: %v", len(errs), errs)
+	}
+	if got := errs[0].Error(); got != "test line 1 col 6: expected integer" {
+		t.Errorf("wrong first error: %s", got)
+	}
+	if got := errs[1].Error(); got != "test line 1 col 14: expected literal ';'" {
+		t.Errorf("wrong second error: %s", got)
+	}
+
+	v, errs := g.ParseStringAll("test", "a=1;b=2;")
+	if errs != nil {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if len(v.([]interface{})) != 2 {
+		t.Errorf("expected 2 statements, got %v", v)
+	}
+
+	// A failure outside any Recover is reported last.
+	g.AddSymbol("START", Then(Many(Recover(Symbol("stmt"), Literal(";"))), Literal(".")))
+	v, errs = g.ParseStringAll("test", "a=;b=2;")
+	if v != nil || len(errs) != 2 {
+		t.Fatalf("expected 2 errors and no value, got %v, %v", v, errs)
+	}
+	if got := errs[1].Error(); got != "test line 1 col 7: expected literal '.'" {
+		t.Errorf("wrong final error: %s", got)
+	}
+}
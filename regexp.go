@@ -0,0 +1,42 @@
+package psec
+
+import "regexp"
+
+// Regexp matches a regular expression, in the syntax of package regexp, at the
+// current position. Its value is the matched text.
+// The pattern is anchored, so it only matches at the start of the remaining
+// input, never further along. It panics if the pattern is invalid, like
+// regexp.MustCompile.
+// Regexp looks at all the remaining input at once, so with ParseReader it
+// reads the rest of the input into memory, and copies what remains each time
+// it's run; on large inputs from a reader, prefer ParseBytes or ParseString.
+func Regexp(pattern string) Parser {
+	return &pRegexp{pattern, regexp.MustCompile(`^(?:` + pattern + `)`)}
+}
+
+type pRegexp struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+func (p *pRegexp) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	var m []int
+	if b, ok := ps.(*bytesPS); ok {
+		// Matching the bytes in place saves copying the rest of the input.
+		m = p.re.FindIndex(b.data[b.pos:])
+	} else {
+		m = p.re.FindStringIndex(ps.RemainingInput())
+	}
+	if m == nil {
+		return nil, ps.Loc().mkErrorExpect("regexp '%s'", p.pattern)
+	}
+	start := ps
+	for i := 0; i < m[1]; i++ {
+		ps = ps.Tail()
+	}
+	return ps.SetValue(matchedText(start, ps)), nil
+}
+
+func (p *pRegexp) describe() string {
+	return "/" + p.pattern + "/"
+}
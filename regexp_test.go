@@ -0,0 +1,27 @@
+package psec
+
+import "testing"
+
+func TestRegexp(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Seq(Regexp(`[0-9]+\.[0-9]+`), Stringify(Many(AnyChar()))))
+	expectStrings(t, g, "3.14xyz", []string{"3.14", "xyz"})
+	expectError(t, g, "x3.14", `expected regexp '[0-9]+\.[0-9]+'`)
+
+	// Alternations are anchored as a whole.
+	g.AddSymbol("START", Regexp("a|b"))
+	expectString(t, g, "b", "b")
+	expectError(t, g, "cb", "expected regexp 'a|b'")
+
+	// Newlines in the match move the position to the following lines.
+	g.AddSymbol("START", Seq(Regexp(`(x\n)+`), Literal("y")))
+	_, err := g.ParseString("test", "x\nx\nz")
+	if err == nil || err.Error() != "test line 3 col 0: expected literal 'y'" {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	_, err = g.ParseBytes("test", []byte("x\nx\nz"))
+	if err == nil || err.Error() != "test line 3 col 0: expected literal 'y'" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package psec
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The rune-oriented parsers. The streams themselves are bytes, so these decode
+// UTF-8 as they go, consuming whole runes and yielding rune values.
+
+// headRune decodes the rune at the front of the stream. It returns the rune and
+// the stream following it, or ok == false at EOF. Invalid UTF-8 decodes as
+// utf8.RuneError, consuming a single byte.
+func headRune(ps Stream) (r rune, rest Stream, ok bool) {
+	var buf [utf8.UTFMax]byte
+	n := 0
+	rest = ps
+	for n < utf8.UTFMax {
+		c, eof := rest.Head()
+		if eof {
+			break
+		}
+		buf[n] = c
+		n++
+		rest = rest.Tail()
+		if utf8.FullRune(buf[:n]) {
+			break
+		}
+	}
+	if n == 0 {
+		return 0, nil, false
+	}
+
+	r, size := utf8.DecodeRune(buf[:n])
+	if size < n {
+		// Only possible for invalid input; back up to just past the one byte.
+		rest = ps.Tail()
+	}
+	return r, rest, true
+}
+
+// AnyRune parses any single UTF-8 encoded rune, returning it as the value.
+func AnyRune() Parser {
+	return &anyRuneSingleton
+}
+
+type pAnyRune struct{}
+
+var anyRuneSingleton pAnyRune
+
+func (p *pAnyRune) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	r, rest, ok := headRune(ps)
+	if !ok {
+		return nil, ps.Loc().mkErrorMessage("unexpected EOF")
+	}
+	return rest.SetValue(r), nil
+}
+
+func (p *pAnyRune) describe() string {
+	return "AnyRune"
+}
+
+// RuneRange parses any rune between lo and hi (inclusive).
+// Value is the parsed rune. Fails on EOF.
+func RuneRange(lo, hi rune) Parser {
+	return &pRuneRange{lo, hi}
+}
+
+type pRuneRange struct {
+	lo, hi rune
+}
+
+func (p *pRuneRange) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	r, rest, ok := headRune(ps)
+	if ok && p.lo <= r && r <= p.hi {
+		return rest.SetValue(r), nil
+	}
+	return nil, ps.Loc().mkErrorExpect("range(%c..%c)", p.lo, p.hi)
+}
+
+func (p *pRuneRange) describe() string {
+	return fmt.Sprintf("%q..%q", string(p.lo), string(p.hi))
+}
+
+// RuneOneOf matches any single rune from a string of possibilities.
+// Its value is that rune.
+func RuneOneOf(options string) Parser {
+	return &pRuneOneOf{options}
+}
+
+type pRuneOneOf struct {
+	options string
+}
+
+func (p *pRuneOneOf) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	r, rest, ok := headRune(ps)
+	if !ok {
+		return nil, ps.Loc().mkErrorMessage("unexpected EOF, expected one of '%s'", p.options)
+	}
+	for _, o := range p.options {
+		if r == o {
+			return rest.SetValue(r), nil
+		}
+	}
+	return nil, ps.Loc().mkErrorMessage("expected one of: %s", p.options)
+}
+
+func (p *pRuneOneOf) describe() string {
+	return fmt.Sprintf("RuneOneOf(%q)", p.options)
+}
+
+// RuneCategory parses any rune in the named Unicode category, such as "L" for
+// letters, "Lu" for upper case letters, or "N" for numbers; see
+// unicode.Categories. Its value is the parsed rune. Fails on EOF.
+// Panics if there's no such category.
+func RuneCategory(name string) Parser {
+	table, ok := unicode.Categories[name]
+	if !ok {
+		panic(fmt.Sprintf("no such Unicode category: '%s'", name))
+	}
+	return &pRuneCategory{name, table}
+}
+
+type pRuneCategory struct {
+	name  string
+	table *unicode.RangeTable
+}
+
+func (p *pRuneCategory) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	r, rest, ok := headRune(ps)
+	if ok && r != utf8.RuneError && unicode.Is(p.table, r) {
+		return rest.SetValue(r), nil
+	}
+	return nil, ps.Loc().mkErrorExpect("rune in category %s", p.name)
+}
+
+func (p *pRuneCategory) describe() string {
+	return fmt.Sprintf("RuneCategory(%q)", p.name)
+}
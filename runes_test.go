@@ -0,0 +1,79 @@
+package psec
+
+import "testing"
+
+func expectRune(t *testing.T, g *Grammar, input string, expected rune) {
+	r, err := g.ParseString("test", input)
+	if err != nil {
+		t.Errorf("unexpected failure: %v", err)
+	}
+
+	if r, ok := r.(rune); ok {
+		if r != expected {
+			t.Errorf("mismatched return, got %c", r)
+		}
+	} else {
+		t.Errorf("return was not a rune: %#v %T", r, r)
+	}
+}
+
+func TestAnyRune(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", SeqAt(1, Literal("h"), AnyRune(), Literal("llo")))
+	expectRune(t, g, "héllo", 'é')
+	expectRune(t, g, "hello", 'e')
+
+	g.AddSymbol("START", AnyRune())
+	expectError(t, g, "", "unexpected EOF")
+}
+
+func TestRuneRange(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", RuneRange('à', 'ÿ'))
+	expectRune(t, g, "é", 'é')
+	expectError(t, g, "e", "expected range(à..ÿ)")
+
+	// A byte Range can't match either half of the é.
+	g.AddSymbol("START", Stringify(Many(Alt(Range('a', 'z'), RuneRange('à', 'ÿ')))))
+	expectString(t, g, "héllo", "héllo")
+}
+
+func TestRuneOneOf(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", RuneOneOf("aéz"))
+	expectRune(t, g, "é", 'é')
+	expectRune(t, g, "z", 'z')
+	expectError(t, g, "è", "expected one of: aéz")
+}
+
+func TestRuneCategory(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", RuneCategory("L"))
+	expectRune(t, g, "λ", 'λ')
+	expectRune(t, g, "x", 'x')
+	expectError(t, g, "!", "expected rune in category L")
+	expectError(t, g, "«", "expected rune in category L")
+	expectError(t, g, "\xff", "expected rune in category L")
+
+	g.AddSymbol("START", RuneCategory("Lu"))
+	expectRune(t, g, "Δ", 'Δ')
+	expectError(t, g, "δ", "expected rune in category Lu")
+
+	g.AddSymbol("START", Stringify(Many1(Alt(RuneCategory("L"), RuneCategory("N")))))
+	expectString(t, g, "αβγ123", "αβγ123")
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected an unknown category to panic")
+		}
+	}()
+	RuneCategory("Xyz")
+}
+
+// Columns advance by one for each rune, however many bytes it is.
+func TestRuneColumns(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", Seq(Literal("h"), AnyRune(), Literal("llo")))
+	expectErrorAt(t, g, "héllx", 2, "expected literal 'llo'")
+	expectErrorAt(t, g, "héllo!", 5, "incomplete parse, expected EOF but input remains: !")
+}
@@ -0,0 +1,89 @@
+package psec
+
+import "fmt"
+
+// User state is an arbitrary value carried along by the Stream. Since streams
+// are immutable, when a parser fails and its caller backtracks, any changes it
+// made to the state are discarded with it.
+// For that to work, treat the state itself as immutable too: UpdateState should
+// build a new value (eg. copy a map before adding to it) rather than modifying
+// the old one in place.
+
+// ParseStringWithState is a variant of ParseString which starts the parse with
+// the given user state.
+func (g *Grammar) ParseStringWithState(filename, str string, state interface{}) (interface{}, error) {
+	return g.parse(&stringPS{
+		str:      str,
+		filename: filename,
+		line:     1,
+		state:    state,
+		arena:    new(streamArena),
+	}, g.startSymbol, g.newContext())
+}
+
+// GetState consumes nothing, and its value is the current user state.
+func GetState() Parser {
+	return &getStateSingleton
+}
+
+type pGetState struct{}
+
+var getStateSingleton pGetState
+
+func (p *pGetState) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	return ps.SetValue(ps.State()), nil
+}
+
+func (p *pGetState) describe() string {
+	return "GetState"
+}
+
+// PutState consumes nothing, and replaces the user state with st.
+// Its value is nil.
+func PutState(st interface{}) Parser {
+	return &pPutState{st}
+}
+
+type pPutState struct {
+	state interface{}
+}
+
+func (p *pPutState) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	return ps.SetState(p.state).SetValue(nil), nil
+}
+
+func (p *pPutState) describe() string {
+	return fmt.Sprintf("PutState(%v)", p.state)
+}
+
+// UpdateState runs its inner parser, and then replaces the user state with the
+// result of calling update with the inner parser's value and the current state.
+// Its value is the inner parser's value.
+// If update returns an error, UpdateState fails with it at the location where
+// the inner parser started. That makes it useful for checks against the state,
+// too, returning the state unchanged if all is well.
+func UpdateState(p Parser, update func(v, state interface{}) (interface{}, error)) Parser {
+	return &pUpdateState{p, update}
+}
+
+type pUpdateState struct {
+	inner  Parser
+	update func(v, state interface{}) (interface{}, error)
+}
+
+func (p *pUpdateState) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
+	ps, err := p.inner.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	st, e := p.update(ps.Value(), ps.State())
+	if e != nil {
+		return nil, start.Loc().mkErrorMessage("%s", e.Error())
+	}
+	return ps.SetState(st), nil
+}
+
+func (p *pUpdateState) describe() string {
+	return "UpdateState(" + describe(p.inner) + ")"
+}
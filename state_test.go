@@ -0,0 +1,70 @@
+package psec
+
+import (
+	"fmt"
+	"testing"
+)
+
+// A toy language of declarations "let x;" and uses "use x;", where only
+// declared names can be used.
+func buildDeclGrammar() *Grammar {
+	g := NewGrammar()
+	g.AddSymbol("ident", Stringify(Many1(Range('a', 'z'))))
+	g.AddSymbol("let", SeqAt(1, Literal("let "),
+		UpdateState(Symbol("ident"), func(v, st interface{}) (interface{}, error) {
+			known := make(map[string]bool)
+			for k := range st.(map[string]bool) {
+				known[k] = true
+			}
+			known[v.(string)] = true
+			return known, nil
+		}),
+		Literal(";")))
+	g.AddSymbol("use", Skip(Literal("use "), Cut(Then(
+		UpdateState(Symbol("ident"), func(v, st interface{}) (interface{}, error) {
+			if !st.(map[string]bool)[v.(string)] {
+				return nil, fmt.Errorf("unknown identifier %s", v)
+			}
+			return st, nil
+		}),
+		Literal(";")))))
+	g.AddSymbol("START", Many(Alt(Symbol("let"), Symbol("use"))))
+	return g
+}
+
+func TestUserState(t *testing.T) {
+	g := buildDeclGrammar()
+	empty := map[string]bool{}
+
+	if _, err := g.ParseStringWithState("test", "let x;use x;", empty); err != nil {
+		t.Errorf("unexpected failure: %v", err)
+	}
+
+	_, err := g.ParseStringWithState("test", "let x;use x;use y;", empty)
+	if err == nil || err.Error() != "test line 1 col 16: unknown identifier y" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestUserStateBacktracking(t *testing.T) {
+	g := buildDeclGrammar()
+
+	// "let y" is parsed by the first branch, which then fails and is abandoned,
+	// so y never becomes known.
+	g.AddSymbol("START", Seq(
+		Alt(Seq(Symbol("let"), Literal("!")), Literal("let y;")),
+		Symbol("use")))
+	_, err := g.ParseStringWithState("test", "let y;use y;", map[string]bool{})
+	if err == nil || err.Error() != "test line 1 col 10: unknown identifier y" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestGetPutState(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", SeqAt(3, GetState(), PutState("new"), Literal("x"), GetState()))
+	r, err := g.ParseStringWithState("test", "x", "old")
+	if err != nil || r != "new" {
+		t.Errorf("expected new state, got %v %v", r, err)
+	}
+}
@@ -0,0 +1,342 @@
+package psec
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Parsers for quoted string literals.
+
+// QuotedString parses a string delimited by quote bytes, with backslash escapes,
+// and its value is the decoded string.
+// escapes maps the byte after a backslash to the byte it stands for, eg. 'n' to
+// '\n'. An escape not in the table is an error. If escapes is nil, the usual
+// \n, \t, \r and \\ are supported, along with an escaped quote.
+// An unterminated string is an error at the opening quote.
+func QuotedString(quote byte, escapes map[byte]byte) Parser {
+	if escapes == nil {
+		escapes = map[byte]byte{
+			'n':   '\n',
+			't':   '\t',
+			'r':   '\r',
+			'\\':  '\\',
+			quote: quote,
+		}
+	}
+	return &pQuotedString{quote, escapes}
+}
+
+type pQuotedString struct {
+	quote   byte
+	escapes map[byte]byte
+}
+
+func (p *pQuotedString) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
+	if c, eof := ps.Head(); eof || c != p.quote {
+		return nil, ps.Loc().mkErrorExpect("string")
+	}
+	ps = ps.Tail()
+
+	var out []byte
+	for {
+		c, eof := ps.Head()
+		if eof {
+			return nil, start.Loc().mkErrorMessage("unterminated string")
+		}
+		if c == p.quote {
+			return ps.Tail().SetValue(string(out)), nil
+		}
+		if c == '\\' {
+			esc := ps
+			ps = ps.Tail()
+			c, eof = ps.Head()
+			if eof {
+				return nil, start.Loc().mkErrorMessage("unterminated string")
+			}
+			decoded, ok := p.escapes[c]
+			if !ok {
+				return nil, esc.Loc().mkErrorMessage("unknown escape \\%c", c)
+			}
+			c = decoded
+		}
+		out = append(out, c)
+		ps = ps.Tail()
+	}
+}
+
+func (p *pQuotedString) describe() string {
+	return fmt.Sprintf("QuotedString(%q)", string(p.quote))
+}
+
+// DoubledQuoteString parses a string delimited by quote bytes, in which two
+// quotes in a row stand for one, as in CSV and SQL: "she said ""hi""".
+// There are no other escapes. Its value is the decoded string.
+// An unterminated string is an error at the opening quote.
+func DoubledQuoteString(quote byte) Parser {
+	return &pDoubledQuoteString{quote}
+}
+
+type pDoubledQuoteString struct {
+	quote byte
+}
+
+func (p *pDoubledQuoteString) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
+	if c, eof := ps.Head(); eof || c != p.quote {
+		return nil, ps.Loc().mkErrorExpect("string")
+	}
+	ps = ps.Tail()
+
+	var out []byte
+	for {
+		c, eof := ps.Head()
+		if eof {
+			return nil, start.Loc().mkErrorMessage("unterminated string")
+		}
+		ps = ps.Tail()
+		if c == p.quote {
+			if next, eof := ps.Head(); eof || next != p.quote {
+				return ps.SetValue(string(out)), nil
+			}
+			ps = ps.Tail()
+		}
+		out = append(out, c)
+	}
+}
+
+func (p *pDoubledQuoteString) describe() string {
+	return fmt.Sprintf("DoubledQuoteString(%q)", string(p.quote))
+}
+
+// RawBalanced parses from open to its matching close, such as the braces of a
+// { ... } block, allowing nested pairs in between. Its value is the raw text
+// between the outermost pair, for parsing later or passing along as is.
+// Delimiters inside double-quoted strings, with backslash escapes, don't count;
+// see RawBalancedQuotes to change which quotes those are.
+// A missing close is an error reported as unclosed from the open.
+func RawBalanced(open, close byte) Parser {
+	return RawBalancedQuotes(open, close, "\"")
+}
+
+// RawBalancedQuotes is a variant of RawBalanced where each byte in quotes
+// starts a quoted string, ending at the next unescaped copy of that byte. An
+// empty quotes means nothing is quoted.
+func RawBalancedQuotes(open, close byte, quotes string) Parser {
+	return &pRawBalanced{open, close, quotes}
+}
+
+type pRawBalanced struct {
+	open, close byte
+	quotes      string
+}
+
+func (p *pRawBalanced) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
+	if c, eof := ps.Head(); eof || c != p.open {
+		return nil, ps.Loc().mkErrorExpect("literal '%c'", p.open)
+	}
+	ps = ps.Tail()
+	body := ps
+
+	depth := 1
+	var quote byte // The quote we're inside, if any.
+	for {
+		c, eof := ps.Head()
+		if eof {
+			return nil, unclosedError(start, string(p.open), ps.Loc().mkErrorExpect("literal '%c'", p.close))
+		}
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				if _, eof := ps.Tail().Head(); !eof {
+					ps = ps.Tail()
+				}
+			} else if c == quote {
+				quote = 0
+			}
+		case strings.IndexByte(p.quotes, c) >= 0:
+			quote = c
+		case c == p.open:
+			depth++
+		case c == p.close:
+			depth--
+			if depth == 0 {
+				return ps.Tail().SetValue(matchedText(body, ps)), nil
+			}
+		}
+		ps = ps.Tail()
+	}
+}
+
+func (p *pRawBalanced) describe() string {
+	return fmt.Sprintf("RawBalancedQuotes(%q, %q, %q)", string(p.open), string(p.close), p.quotes)
+}
+
+// InterpolatedString parses a string delimited by quote bytes, which may contain
+// interpolated expressions between interpOpen and interpClose, as in shell's
+// "hi ${name}!". Its value is a slice of the string's segments in order: the
+// literal text between expressions, as decoded strings, and the values of expr
+// for the expressions. Empty text segments are left out, so "${a}${b}" yields
+// just the two expression values.
+// Literal text has the same default escapes as QuotedString, and a backslash
+// also escapes the first byte of interpOpen, so "\${" is a literal "${".
+// An unterminated string is an error at the opening quote, and a missing
+// interpClose at the interpOpen it belongs to.
+func InterpolatedString(quote byte, interpOpen, interpClose string, expr Parser) Parser {
+	escapes := map[byte]byte{
+		'n':           '\n',
+		't':           '\t',
+		'r':           '\r',
+		'\\':          '\\',
+		quote:         quote,
+		interpOpen[0]: interpOpen[0],
+	}
+	return &pInterpolatedString{quote, interpOpen, interpClose, expr, escapes}
+}
+
+type pInterpolatedString struct {
+	quote       byte
+	open, close string
+	expr        Parser
+	escapes     map[byte]byte
+}
+
+func (p *pInterpolatedString) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
+	if c, eof := ps.Head(); eof || c != p.quote {
+		return nil, ps.Loc().mkErrorExpect("string")
+	}
+	ps = ps.Tail()
+
+	segments := make([]interface{}, 0)
+	var text []byte
+	flush := func() {
+		if len(text) > 0 {
+			segments = append(segments, string(text))
+			text = nil
+		}
+	}
+	for {
+		c, eof := ps.Head()
+		if eof {
+			return nil, start.Loc().mkErrorMessage("unterminated string")
+		}
+		if c == p.quote {
+			flush()
+			return ps.Tail().SetValue(segments), nil
+		}
+		if open := skipPrefix(ps, p.open); open != nil {
+			flush()
+			ends, err := p.expr.Parse(open, g)
+			if err != nil {
+				return nil, err
+			}
+			closed := skipPrefix(ends, p.close)
+			if closed == nil {
+				return nil, unclosedError(ps, p.open,
+					ends.Loc().mkErrorExpect("literal '%s'", p.close))
+			}
+			segments = append(segments, ends.Value())
+			ps = closed
+			continue
+		}
+		if c == '\\' {
+			esc := ps
+			ps = ps.Tail()
+			c, eof = ps.Head()
+			if eof {
+				return nil, start.Loc().mkErrorMessage("unterminated string")
+			}
+			decoded, ok := p.escapes[c]
+			if !ok {
+				return nil, esc.Loc().mkErrorMessage("unknown escape \\%c", c)
+			}
+			c = decoded
+		}
+		text = append(text, c)
+		ps = ps.Tail()
+	}
+}
+
+func (p *pInterpolatedString) describe() string {
+	return fmt.Sprintf("InterpolatedString(%q, %q, %q, %s)", string(p.quote), p.open, p.close, describe(p.expr))
+}
+
+// HereDoc parses the lines of a here-document, up to a line equal to
+// terminator, and its value is their text with the indentation they all share
+// removed. Each line keeps its newline. HereDoc should start at the beginning
+// of the first line, and parsing the <<EOF or similar that introduces it is up
+// to the caller. It stops after the terminator, before its newline.
+//
+// Blank lines, with only spaces and tabs, don't count when finding the shared
+// indentation. Indentation is compared literally, so a tab and a space don't
+// match each other.
+// An unterminated here-doc is an error at its first line.
+func HereDoc(terminator string) Parser {
+	return &pHereDoc{terminator}
+}
+
+type pHereDoc struct {
+	terminator string
+}
+
+func (p *pHereDoc) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	start := ps
+	var lines []string
+	var line []byte
+	for {
+		c, eof := ps.Head()
+		if eof || c == '\n' {
+			if string(line) == p.terminator {
+				return ps.SetValue(dedent(lines)), nil
+			}
+			if eof {
+				return nil, start.Loc().mkErrorMessage("unterminated here-doc")
+			}
+			lines = append(lines, string(line)+"\n")
+			line = line[:0]
+		} else {
+			line = append(line, c)
+		}
+		ps = ps.Tail()
+	}
+}
+
+func (p *pHereDoc) describe() string {
+	return fmt.Sprintf("HereDoc(%q)", p.terminator)
+}
+
+// dedent joins lines, removing the longest prefix of spaces and tabs shared by
+// all the ones that aren't blank.
+func dedent(lines []string) string {
+	prefix, found := "", false
+	for _, l := range lines {
+		rest := strings.TrimLeft(l, " \t")
+		if rest == "\n" {
+			continue
+		}
+		indent := l[:len(l)-len(rest)]
+		if !found {
+			prefix, found = indent, true
+			continue
+		}
+		n := 0
+		for n < len(prefix) && n < len(indent) && prefix[n] == indent[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+
+	var out strings.Builder
+	for _, l := range lines {
+		if strings.HasPrefix(l, prefix) {
+			l = l[len(prefix):]
+		} else {
+			// Only blank lines can be missing the prefix.
+			l = "\n"
+		}
+		out.WriteString(l)
+	}
+	return out.String()
+}
@@ -0,0 +1,111 @@
+package psec
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestQuotedString(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", QuotedString('"', nil))
+	expectString(t, g, `"abc"`, "abc")
+	expectString(t, g, `""`, "")
+	expectString(t, g, `"a\"b"`, `a"b`)
+	expectString(t, g, `"line1\nline2"`, "line1\nline2")
+	expectString(t, g, `"back\\slash"`, `back\slash`)
+	expectError(t, g, `"abc`, "unterminated string")
+	expectError(t, g, `"abc\`, "unterminated string")
+	expectErrorAt(t, g, `"a\qb"`, 2, "unknown escape \\q")
+	expectError(t, g, `abc`, "expected string")
+}
+
+func TestQuotedStringCustomEscapes(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", QuotedString('\'', map[byte]byte{'\'': '\'', '0': 0}))
+	expectString(t, g, `'it\'s'`, "it's")
+	expectString(t, g, `'nul\0'`, "nul\x00")
+	expectErrorAt(t, g, `'\n'`, 1, "unknown escape \\n")
+}
+
+func TestDoubledQuoteString(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", DoubledQuoteString('"'))
+	expectString(t, g, `"a""b"`, `a"b`)
+	expectString(t, g, `"she said ""hi"""`, `she said "hi"`)
+	expectString(t, g, `""`, "")
+	expectString(t, g, `""""`, `"`)
+	expectString(t, g, `"back\slash"`, `back\slash`)
+	expectError(t, g, `"abc`, "unterminated string")
+	expectError(t, g, `"abc""`, "unterminated string")
+	expectError(t, g, `abc`, "expected string")
+	expectErrorAt(t, g, `"a"b"`, 3, "incomplete parse, expected EOF but input remains: b\"")
+
+	g.AddSymbol("START", DoubledQuoteString('\''))
+	expectString(t, g, `'it''s'`, "it's")
+}
+
+func TestRawBalanced(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", RawBalanced('{', '}'))
+	expectString(t, g, "{ a { b } c }", " a { b } c ")
+	expectString(t, g, "{}", "")
+	expectString(t, g, `{ s = "}"; t = "\"{" }`, ` s = "}"; t = "\"{" `)
+	expectErrorAt(t, g, "{ a { b }", 9, "unclosed '{' opened at line 1 col 0, expected literal '}'")
+	expectErrorAt(t, g, `{ "}`, 4, "unclosed '{' opened at line 1 col 0, expected literal '}'")
+	expectError(t, g, "a", "expected literal '{'")
+
+	g.AddSymbol("START", SeqAt(1, Literal("f"), RawBalanced('(', ')'), Literal(";")))
+	expectString(t, g, "f(g(x), (y));", "g(x), (y)")
+
+	g.AddSymbol("START", RawBalancedQuotes('[', ']', "'"))
+	expectString(t, g, `['a]' "]`, `'a]' "`)
+
+	g.AddSymbol("START", RawBalancedQuotes('{', '}', ""))
+	expectErrorAt(t, g, `{ "}" }`, 4, `incomplete parse, expected EOF but input remains: " }`)
+}
+
+func TestInterpolatedString(t *testing.T) {
+	variable := Map(Stringify(Many1(Letter())), func(res interface{}, loc *Loc) (interface{}, error) {
+		return "<expr " + res.(string) + ">", nil
+	})
+	g := NewGrammar()
+	g.AddSymbol("START", InterpolatedString('"', "${", "}", variable))
+
+	for in, want := range map[string]string{
+		`"hi ${name}!"`:         `["hi " "<expr name>" "!"]`,
+		`"${a}${b}"`:            `["<expr a>" "<expr b>"]`,
+		`""`:                    `[]`,
+		`"cost: \${x} \"q\"\n"`: `["cost: ${x} \"q\"\n"]`,
+		`"$5 {x}"`:              `["$5 {x}"]`,
+	} {
+		r, err := g.ParseString("test", in)
+		if err != nil {
+			t.Errorf("%s: unexpected failure: %v", in, err)
+			continue
+		}
+		if got := fmt.Sprintf("%q", r); got != want {
+			t.Errorf("%s: expected %s, got %s", in, want, got)
+		}
+	}
+
+	expectError(t, g, `"hi there`, "unterminated string")
+	expectErrorAt(t, g, `"hi ${name`, 10, "unclosed '${' opened at line 1 col 4, expected literal '}'")
+	expectErrorAt(t, g, `"hi ${name!}"`, 10, "unclosed '${' opened at line 1 col 4, expected literal '}'")
+	expectErrorAt(t, g, `"hi ${}"`, 6, "minimum 1, expected letter")
+	expectErrorAt(t, g, `"a\qb"`, 2, "unknown escape \\q")
+	expectError(t, g, `x`, "expected string")
+}
+
+func TestHereDoc(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", SeqAt(1, Literal("<<END\n"), HereDoc("END")))
+	expectString(t, g, "<<END\n    one\n      two\n    three\nEND", "one\n  two\nthree\n")
+	expectString(t, g, "<<END\n  one\n\n \n  two\nEND", "one\n\n\ntwo\n")
+	expectString(t, g, "<<END\n\tone\n  two\nEND", "\tone\n  two\n")
+	expectString(t, g, "<<END\nEND", "")
+
+	_, err := g.ParseString("test", "<<END\n  one\n  END")
+	if err == nil || err.Error() != "test line 2 col 0: unterminated here-doc" {
+		t.Errorf("expected an unterminated here-doc, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package psec
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// IntoStruct converts the []interface{} value of p, typically a Seq, into a
+// struct: target is a pointer to a struct of the desired type, used only for
+// its type, and IntoStruct's value is a pointer to a new struct of that type.
+// The results are assigned to the exported fields in declaration order, but a
+// field tagged `psec:"N"` takes the result at index N instead, and fields tagged
+// `psec:"-"` are skipped. Tagged fields don't use up a position, so
+//
+//	IntoStruct(Seq(Integer(), Literal(":"), Symbol("name")), &struct {
+//		ID   int
+//		Name string `psec:"2"`
+//	}{})
+//
+// skips over the ":". A nil result leaves its field as the zero value.
+// It is an error, at the start of p, if a result has the wrong type for its
+// field. IntoStruct panics if target is not a pointer to a struct, or a tag is
+// malformed.
+func IntoStruct(p Parser, target interface{}) Parser {
+	t := reflect.TypeOf(target)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("psec: IntoStruct target must be a pointer to a struct, not %T", target))
+	}
+	t = t.Elem()
+
+	// fields[i] is the index of the result for field i, or -1 to skip it.
+	fields := make([]int, t.NumField())
+	next := 0
+	for i := range fields {
+		f := t.Field(i)
+		tag, tagged := f.Tag.Lookup("psec")
+		switch {
+		case tag == "-" || (!tagged && f.PkgPath != ""):
+			fields[i] = -1
+		case tagged:
+			n, err := strconv.Atoi(tag)
+			if err != nil || n < 0 || f.PkgPath != "" {
+				panic(fmt.Sprintf("psec: IntoStruct: bad tag %q on field %s", tag, f.Name))
+			}
+			fields[i] = n
+		default:
+			fields[i] = next
+			next++
+		}
+	}
+
+	return MapLoc(p, func(res interface{}, loc *Loc) (interface{}, error) {
+		results, ok := res.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("IntoStruct needs a list of results, not %T", res)
+		}
+		out := reflect.New(t)
+		for i, n := range fields {
+			if n < 0 {
+				continue
+			}
+			f := t.Field(i)
+			if n >= len(results) {
+				return nil, fmt.Errorf("field %s wants result %d, but there are only %d", f.Name, n, len(results))
+			}
+			if results[n] == nil {
+				continue
+			}
+			v := reflect.ValueOf(results[n])
+			if !v.Type().AssignableTo(f.Type) {
+				return nil, fmt.Errorf("cannot assign %T to field %s of type %s", results[n], f.Name, f.Type)
+			}
+			out.Elem().Field(i).Set(v)
+		}
+		return out.Interface(), nil
+	})
+}
@@ -0,0 +1,32 @@
+package psec
+
+import "testing"
+
+type record struct {
+	ID   int
+	Name string `psec:"2"`
+	Note string `psec:"-"`
+}
+
+func TestIntoStruct(t *testing.T) {
+	g := NewGrammar()
+	g.AddSymbol("START", IntoStruct(Seq(Integer(), Literal(":"), QuotedString('"', nil)), &record{}))
+	r, err := g.ParseString("test", `42:"answer"`)
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if rec := r.(*record); *rec != (record{ID: 42, Name: "answer"}) {
+		t.Errorf("wrong result: %+v", *rec)
+	}
+
+	// Results of the wrong type are errors.
+	g.AddSymbol("START", IntoStruct(Seq(QuotedString('"', nil), Literal(":"), QuotedString('"', nil)), &record{}))
+	expectError(t, g, `"x":"y"`, "cannot assign string to field ID of type int")
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a panic for a non-struct target")
+		}
+	}()
+	IntoStruct(Integer(), 7)
+}
@@ -0,0 +1,236 @@
+package psec
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Lexing and parsing in two phases: a Lexer breaks the input into Tokens, and
+// then a grammar built from TokenKind and TokenText parses those, rather than
+// bytes. That keeps whitespace and the details of each token's spelling out of
+// the grammar proper.
+
+// Token is one token of the input, as produced by a Lexer. Tokens built by
+// hand for ParseTokens must have their Loc set.
+type Token struct {
+	Kind string
+	Text string
+	Loc  *Loc
+}
+
+func (t Token) String() string {
+	return fmt.Sprintf("%s %q", t.Kind, t.Text)
+}
+
+// Lexer breaks input into Tokens, by an ordered list of rules.
+// Declare the rules, then call Lex.
+type Lexer struct {
+	rules []Parser
+	skip  Parser
+}
+
+// NewLexer returns a Lexer with no rules, which skips the same whitespace as
+// Lexeme does by default.
+func NewLexer() *Lexer {
+	return &Lexer{skip: ManyDrop(OneOf(" \t\r\n"))}
+}
+
+// Rule declares a kind of token, matched by p. At each position, the rules are
+// tried in the order they were declared, and the first to match wins.
+// p's value is ignored; the token's Text is the input p matched. p is labelled
+// with the kind, for the errors when nothing matches.
+func (l *Lexer) Rule(kind string, p Parser) {
+	l.rules = append(l.rules, &pLexRule{kind, Label(kind, p)})
+}
+
+// Skip replaces the parser for what comes between tokens, such as whitespace
+// and comments. Its value is ignored.
+func (l *Lexer) Skip(p Parser) {
+	l.skip = p
+}
+
+type pLexRule struct {
+	kind  string
+	inner Parser
+}
+
+func (p *pLexRule) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	res, err := p.inner.Parse(ps, g)
+	if err != nil {
+		return nil, err
+	}
+	return res.SetValue(Token{p.kind, matchedText(ps, res), ps.Loc()}), nil
+}
+
+func (p *pLexRule) describe() string {
+	return describe(p.inner)
+}
+
+// Lex breaks the whole of str into tokens. If no rule matches at some point,
+// the error is the one Alt would give over all the rules, typically listing the
+// expected kinds.
+func (l *Lexer) Lex(filename, str string) ([]Token, error) {
+	ctx := NewGrammar().newContext()
+	rule := Alt(l.rules...)
+
+	var ps Stream = &stringPS{
+		str:      str,
+		filename: filename,
+		line:     1,
+		arena:    new(streamArena),
+	}
+	tokens := make([]Token, 0)
+	for {
+		skipped, err := l.skip.Parse(ps, ctx)
+		if err != nil {
+			return nil, err
+		}
+		ps = skipped
+		if _, eof := ps.Head(); eof {
+			return tokens, nil
+		}
+
+		next, err := rule.Parse(ps, ctx)
+		if err != nil {
+			return nil, err
+		}
+		tok := next.Value().(Token)
+		if tok.Text == "" {
+			return nil, ps.Loc().mkErrorMessage("lexer rule %s matched no input", tok.Kind)
+		}
+		tokens = append(tokens, tok)
+		ps = next
+	}
+}
+
+// ParseTokens is a variant of ParseString which parses tokens from a Lexer.
+// The grammar should be built from TokenKind and TokenText; parsers for bytes
+// see no input at all.
+func (g *Grammar) ParseTokens(filename string, tokens []Token) (interface{}, error) {
+	for i, tok := range tokens {
+		if tok.Loc == nil {
+			return nil, fmt.Errorf("psec: ParseTokens: token %d, %v, has no Loc", i, tok)
+		}
+	}
+	end := &Loc{Filename: filename, Line: 1}
+	if len(tokens) > 0 {
+		last := tokens[len(tokens)-1]
+		dup := *last.Loc
+		for i := 0; i < len(last.Text); i++ {
+			dup.Line, dup.Col = advanceLoc(dup.Line, dup.Col, last.Text[i])
+		}
+		dup.Offset += len(last.Text)
+		end = &dup
+	}
+	return g.parse(&tokenPS{tokens: tokens, end: end}, g.startSymbol, g.newContext())
+}
+
+// tokenPS is a Stream over a slice of Tokens. Like stringPS, it is treated as
+// immutable. Its Head is always EOF, so that parsers for bytes fail cleanly
+// rather than reading tokens as bytes.
+type tokenPS struct {
+	tokens []Token
+	pos    int
+	end    *Loc // Location just past the last token.
+	value  interface{}
+	state  interface{}
+}
+
+func (s *tokenPS) Head() (byte, bool) {
+	return 0, true
+}
+
+func (s *tokenPS) atEnd() bool { return s.pos >= len(s.tokens) }
+
+func (s *tokenPS) Tail() Stream {
+	dup := *s
+	dup.pos++
+	dup.value = nil
+	return &dup
+}
+
+func (s *tokenPS) Value() interface{} { return s.value }
+func (s *tokenPS) SetValue(v interface{}) Stream {
+	dup := *s
+	dup.value = v
+	return &dup
+}
+
+func (s *tokenPS) State() interface{} { return s.state }
+func (s *tokenPS) SetState(st interface{}) Stream {
+	dup := *s
+	dup.state = st
+	return &dup
+}
+
+func (s *tokenPS) Loc() *Loc {
+	if s.pos >= len(s.tokens) {
+		return s.end
+	}
+	return s.tokens[s.pos].Loc
+}
+
+func (s *tokenPS) Offset() int { return s.Loc().Offset }
+
+// RemainingInput returns the text of the remaining tokens, separated by spaces.
+func (s *tokenPS) RemainingInput() string {
+	texts := make([]string, 0, len(s.tokens)-s.pos)
+	for _, t := range s.tokens[s.pos:] {
+		texts = append(texts, t.Text)
+	}
+	return strings.Join(texts, " ")
+}
+
+// textTo returns the text of the tokens up to to, separated by spaces like
+// RemainingInput. Offsets are into the source the tokens came from, so they
+// can't be used to slice the tokens' text.
+func (s *tokenPS) textTo(to Stream) string {
+	texts := make([]string, 0, to.(*tokenPS).pos-s.pos)
+	for _, t := range s.tokens[s.pos:to.(*tokenPS).pos] {
+		texts = append(texts, t.Text)
+	}
+	return strings.Join(texts, " ")
+}
+
+// TokenKind parses one token of the given kind, and its value is the Token.
+// It can only be used with ParseTokens, and panics on any other Stream.
+func TokenKind(kind string) Parser {
+	return &pToken{kind: kind}
+}
+
+// TokenText parses one token with exactly the given text, of any kind, and its
+// value is the Token.
+// It can only be used with ParseTokens, and panics on any other Stream.
+func TokenText(text string) Parser {
+	return &pToken{text: text, byText: true}
+}
+
+type pToken struct {
+	kind, text string
+	byText     bool
+}
+
+func (p *pToken) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	ts, ok := ps.(*tokenPS)
+	if !ok {
+		// Like an unknown Symbol, this is a programming error.
+		panic(fmt.Sprintf("psec: token parser used on %T, not a token stream", ps))
+	}
+	if ts.pos < len(ts.tokens) {
+		tok := ts.tokens[ts.pos]
+		if (p.byText && tok.Text == p.text) || (!p.byText && tok.Kind == p.kind) {
+			return ts.Tail().SetValue(tok), nil
+		}
+	}
+	if p.byText {
+		return nil, ps.Loc().mkErrorExpect("'%s'", p.text)
+	}
+	return nil, ps.Loc().mkErrorExpect("%s", p.kind)
+}
+
+func (p *pToken) describe() string {
+	if p.byText {
+		return fmt.Sprintf("TokenText(%q)", p.text)
+	}
+	return fmt.Sprintf("TokenKind(%q)", p.kind)
+}
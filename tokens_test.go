@@ -0,0 +1,144 @@
+package psec
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func buildArithLexer() *Lexer {
+	l := NewLexer()
+	l.Rule("number", Many1(Digit()))
+	l.Rule("ident", Many1(Letter()))
+	l.Rule("op", OneOf("+-*/()"))
+	return l
+}
+
+func buildArithTokenGrammar() *Grammar {
+	num := Map(TokenKind("number"), func(res interface{}, loc *Loc) (interface{}, error) {
+		return strconv.Atoi(res.(Token).Text)
+	})
+	table := NewExpressionTable(Alt(num,
+		SeqAt(1, TokenText("("), Symbol("expr"), TokenText(")"))))
+	table.Infix(TokenText("+"), 1, AssocLeft, func(a, b interface{}) interface{} { return a.(int) + b.(int) })
+	table.Infix(TokenText("-"), 1, AssocLeft, func(a, b interface{}) interface{} { return a.(int) - b.(int) })
+	table.Infix(TokenText("*"), 2, AssocLeft, func(a, b interface{}) interface{} { return a.(int) * b.(int) })
+
+	g := NewGrammar()
+	g.AddSymbol("expr", table.Build())
+	g.AddSymbol("START", Symbol("expr"))
+	return g
+}
+
+func TestLexer(t *testing.T) {
+	tokens, err := buildArithLexer().Lex("test", " 12 + x*(3 -\n4)")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	want := `[number "12" op "+" ident "x" op "*" op "(" number "3" op "-" number "4" op ")"]`
+	if got := fmt.Sprint(tokens); got != want {
+		t.Errorf("wrong tokens: %s", got)
+	}
+	if loc := tokens[7].Loc; loc.Line != 2 || loc.Col != 0 || loc.Offset != 13 {
+		t.Errorf("wrong location for the last number: %v", loc)
+	}
+
+	_, err = buildArithLexer().Lex("test", "1 + $")
+	if err == nil || err.Error() != "test line 1 col 4: expected one of number, ident, op" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestParseTokens(t *testing.T) {
+	l := buildArithLexer()
+	g := buildArithTokenGrammar()
+
+	tokens, err := l.Lex("test", "2 * (3 + 4) - 1")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	r, err := g.ParseTokens("test", tokens)
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if r != 13 {
+		t.Errorf("expected 13, got %v", r)
+	}
+
+	tokens, _ = l.Lex("test", "2 * x")
+	_, err = g.ParseTokens("test", tokens)
+	if err == nil || err.Error() != "test line 1 col 2: incomplete parse, expected EOF but input remains: * x" {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	tokens, _ = l.Lex("test", "(1 + 2")
+	_, err = g.ParseTokens("test", tokens)
+	if err == nil || err.Error() != "test line 1 col 6: expected ')'" {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	_, err = g.ParseTokens("test", []Token{{Kind: "number", Text: "1"}})
+	if err == nil || err.Error() != `psec: ParseTokens: token 0, number "1", has no Loc` {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+// Parsers for bytes see no input in a token stream.
+func TestParseTokensBytes(t *testing.T) {
+	tokens, err := buildArithLexer().Lex("test", "1 2")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	g := NewGrammar()
+	g.AddSymbol("START", Seq(Many(AnyChar()), Many(TokenKind("number")), EOF()))
+	r, err := g.ParseTokens("test", tokens)
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	parts := r.([]interface{})
+	if chars := parts[0].([]interface{}); len(chars) != 0 {
+		t.Errorf("expected no bytes, got %v", chars)
+	}
+	if nums := parts[1].([]interface{}); len(nums) != 2 {
+		t.Errorf("expected two numbers, got %v", nums)
+	}
+
+	g.AddSymbol("START", AnyChar())
+	_, err = g.ParseTokens("test", tokens)
+	if err == nil || err.Error() != "test line 1 col 0: unexpected EOF" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+// Token offsets are into the source, which is much longer than the tokens'
+// text when there's whitespace, so matched text must come from the tokens.
+func TestParseTokensBetween(t *testing.T) {
+	l := buildArithLexer()
+	g := NewGrammar()
+	g.AddSymbol("START", Between(TokenText("("), TokenKind("ident"), TokenText(")")))
+
+	tokens, err := l.Lex("test", "(                    abc )")
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	r, err := g.ParseTokens("test", tokens)
+	if err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if tok := r.(Token); tok.Text != "abc" {
+		t.Errorf("expected abc, got %v", tok)
+	}
+
+	tokens, _ = l.Lex("test", "(                    abc")
+	_, err = g.ParseTokens("test", tokens)
+	if err == nil || err.Error() != "test line 1 col 24: unclosed '(' opened at line 1 col 0, expected ')'" {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	g.AddSymbol("START", Captured(Seq(TokenText("("), TokenKind("ident"), TokenText(")"))))
+	tokens, _ = l.Lex("test", "(       abc   )")
+	r, err = g.ParseTokens("test", tokens)
+	if err != nil || r != "( abc )" {
+		t.Errorf("expected the tokens' text, got %q, %v", r, err)
+	}
+}
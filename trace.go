@@ -0,0 +1,42 @@
+package psec
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Trace wraps another parser, logging each time it is tried: its label and
+// position on entry, and on exit either its value or its error. Nested Traces
+// are indented to show the nesting.
+// The log goes to the grammar's trace output; see Grammar.SetTraceOutput.
+func Trace(label string, p Parser) Parser {
+	return &pTrace{p, label}
+}
+
+type pTrace struct {
+	inner Parser
+	label string
+}
+
+func (p *pTrace) Parse(ps Stream, g *parseContext) (Stream, *ParseError) {
+	if g.trace == nil {
+		return p.inner.Parse(ps, g)
+	}
+	indent := strings.Repeat("  ", g.traceDepth)
+	fmt.Fprintf(g.trace, "%s%s: enter at %s\n", indent, p.label, ps.Loc())
+
+	g.traceDepth++
+	res, err := p.inner.Parse(ps, g)
+	g.traceDepth--
+
+	if err != nil {
+		fmt.Fprintf(g.trace, "%s%s: failed: %v\n", indent, p.label, err)
+	} else {
+		fmt.Fprintf(g.trace, "%s%s: ok at %s: %v\n", indent, p.label, res.Loc(), res.Value())
+	}
+	return res, err
+}
+
+func (p *pTrace) describe() string {
+	return describe(p.inner)
+}
@@ -0,0 +1,37 @@
+package psec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	var buf bytes.Buffer
+	g := NewGrammar()
+	g.SetTraceOutput(&buf)
+	g.AddSymbol("START", Trace("list", Many(Trace("item", Literal("a")))))
+	for _, in := range []string{"", "a"} {
+		if _, err := g.ParseString("test", in); err != nil {
+			t.Fatalf("unexpected failure: %v", err)
+		}
+	}
+
+	want := `list: enter at test line 1 col 0
+  item: enter at test line 1 col 0
+  item: failed: test line 1 col 0: expected literal 'a'
+list: ok at test line 1 col 0: []
+list: enter at test line 1 col 0
+  item: enter at test line 1 col 0
+  item: ok at test line 1 col 1: a
+  item: enter at test line 1 col 1
+  item: failed: test line 1 col 1: expected literal 'a'
+list: ok at test line 1 col 1: [a]
+`
+	if buf.String() != want {
+		t.Errorf("wrong trace output:\n%s", buf.String())
+	}
+
+	// With no output, the Traces just run their parsers.
+	g.SetTraceOutput(nil)
+	expectStrings(t, g, "aa", []string{"a", "a"})
+}